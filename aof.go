@@ -0,0 +1,46 @@
+package redisproto
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrTruncatedAOF is returned by AOFReader.Next when the stream ends in the middle of the final command.
+var ErrTruncatedAOF = errors.New("redisproto: truncated AOF command")
+
+// AOFReader reads the commands of a Redis append only file, which is a concatenation of RESP multi-bulk
+// commands.
+type AOFReader struct {
+	parser *Parser
+	offset int64
+}
+
+// aofMaxNumArg replaces MaxNumArg for AOF replay: a rewrite batches 64 items per command and commands like MSET
+// are logged as the client sent them, a file is trusted input unlike a client connection.
+const aofMaxNumArg = 1 << 20
+
+func NewAOFReader(reader io.Reader) *AOFReader {
+	parser := NewParserWithOptions(reader, ParserOptions{Mode: ModeServer})
+	parser.numArgs = aofMaxNumArg
+	return &AOFReader{parser: parser}
+}
+
+// Next returns the next command, copied so it can be accumulated. It returns io.EOF when the file ends at a
+// command boundary and ErrTruncatedAOF when the final command is incomplete; Offset then tells where the
+// truncated command starts, the length to truncate the file to for repairing it.
+func (a *AOFReader) Next() (*Command, error) {
+	a.offset = a.parser.Position()
+	cmd, err := a.parser.ReadCommand()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrTruncatedAOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cmd.Copy(), nil
+}
+
+// Offset returns the stream offset where the command last returned (or failed) by Next starts.
+func (a *AOFReader) Offset() int64 {
+	return a.offset
+}
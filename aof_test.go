@@ -0,0 +1,49 @@
+package redisproto
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestAOFReader(t *testing.T) {
+	aof := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	reader := NewAOFReader(strings.NewReader(aof))
+	var cmds []*Command
+	for {
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	if len(cmds) != 2 || string(cmds[0].Get(0)) != "SELECT" || string(cmds[1].Get(2)) != "1" {
+		t.Errorf("Unexpected commands %d", len(cmds))
+	}
+}
+
+func TestAOFReader_Truncated(t *testing.T) {
+	complete := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"
+	reader := NewAOFReader(strings.NewReader(complete + "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1"))
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := reader.Next(); err != ErrTruncatedAOF {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if reader.Offset() != int64(len(complete)) {
+		t.Errorf("Unexpected offset %d", reader.Offset())
+	}
+}
+
+func TestAOFReader_ManyArgs(t *testing.T) {
+	// an AOF rewrite batches up to 64 items per RPUSH, more than MaxNumArg
+	aof := "*66\r\n$5\r\nRPUSH\r\n$4\r\nlist\r\n" + strings.Repeat("$1\r\nx\r\n", 64)
+	cmd, err := NewAOFReader(strings.NewReader(aof)).Next()
+	if err != nil || cmd.ArgCount() != 66 || string(cmd.Get(65)) != "x" {
+		t.Errorf("Unexpected command %v", err)
+	}
+}
@@ -0,0 +1,801 @@
+package redisproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// ErrOddPairs is returned by ForEachPair when arguments after the command name can't be split into pairs.
+var ErrOddPairs = errors.New("redisproto: odd number of arguments for pairs")
+
+// ErrWrongArgc is wrapped by the errors of ExpectArgc and ExpectArgcRange.
+var ErrWrongArgc = errors.New("redisproto: wrong number of arguments")
+
+// argcError reads like the Redis arity error, so it can be passed to Writer.WriteError as is.
+type argcError struct {
+	name string
+}
+
+func (e *argcError) Error() string {
+	return "ERR wrong number of arguments for '" + e.name + "' command"
+}
+
+func (e *argcError) Unwrap() error {
+	return ErrWrongArgc
+}
+
+// CommandType tells which RESP frame a Command was parsed from, the value is the frame's type char.
+type CommandType byte
+
+const (
+	Multi  CommandType = '*'
+	Bulk   CommandType = '$'
+	Number CommandType = ':'
+	Status CommandType = '+'
+	Error  CommandType = '-'
+
+	// RESP3 only types, see Parser.SetProtocolVersion.
+	Double    CommandType = ','
+	Boolean   CommandType = '#'
+	Null      CommandType = '_'
+	BigNumber CommandType = '('
+	Verbatim  CommandType = '='
+	BlobError CommandType = '!'
+	Map       CommandType = '%'
+	Set       CommandType = '~'
+	Push      CommandType = '>'
+	Attribute CommandType = '|'
+)
+
+// Allocator provides the memory of copied commands, e.g. from an arena or a slab pool. Alloc must return a slice
+// of length n that stays valid and unused by anything else for as long as the copy it backs is in use; the
+// package never frees or reuses it, releasing it (e.g. resetting the arena) is up to the caller once the copies
+// are dropped.
+type Allocator interface {
+	Alloc(n int) []byte
+}
+
+var typeNames = map[CommandType]string{
+	Multi: "Multi", Bulk: "Bulk", Number: "Number", Status: "Status", Error: "Error", Double: "Double",
+	Boolean: "Boolean", Null: "Null", BigNumber: "BigNumber", Verbatim: "Verbatim", BlobError: "BlobError",
+	Map: "Map", Set: "Set", Push: "Push", Attribute: "Attribute",
+}
+
+func (t CommandType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "CommandType(" + strconv.QuoteRune(rune(t)) + ")"
+}
+
+// maxDumpArg is the length past which String truncates an argument.
+const maxDumpArg = 64
+
+type Command struct {
+	argv     [][]byte
+	last     bool
+	raw      []byte
+	bytes    int
+	typ      CommandType
+	num      int64
+	children []*Command
+	null     bool
+	pooled   bool
+	nulls    []uint64 // bitset of null arguments
+	scalar   [1][]byte
+	streamed bool
+	alloc    Allocator
+	inline   bool
+}
+
+// newScalar creates a command of a scalar type holding arg, argv points to the command itself to save an
+// allocation per reply.
+func newScalar(typ CommandType, arg []byte) *Command {
+	cmd := &Command{typ: typ}
+	cmd.scalar[0] = arg
+	cmd.argv = cmd.scalar[:]
+	return cmd
+}
+
+// newBulk creates a Bulk command holding arg.
+func newBulk(arg []byte) *Command {
+	cmd := newScalar(Bulk, arg)
+	if arg == nil {
+		cmd.setNull(0)
+	}
+	return cmd
+}
+
+// NewCommand builds a Multi command of args, e.g. for tests or for a proxy to send its own commands with Encode.
+// The arguments are referenced, not copied, and a nil one is a null bulk.
+func NewCommand(args ...[]byte) *Command {
+	cmd := &Command{argv: make([][]byte, 0, len(args)), typ: Multi}
+	for _, arg := range args {
+		cmd.AppendArg(arg)
+	}
+	return cmd
+}
+
+// AppendArg adds b as the last argument, e.g. for a proxy to add a flag before forwarding the command. Like
+// SetArg it leaves the command without Raw bytes since they no longer match it, Encode writes the new arguments.
+func (c *Command) AppendArg(b []byte) {
+	c.argv = append(c.argv, b)
+	if c.children != nil {
+		c.children = append(c.children, newBulk(b))
+	}
+	if b == nil {
+		c.setNull(len(c.argv) - 1)
+	}
+	c.raw = nil
+}
+
+// SetArg replaces the argument at index with b, e.g. to prefix a key. It panics if index is out of range.
+func (c *Command) SetArg(index int, b []byte) {
+	c.argv[index] = b
+	if c.children != nil {
+		c.children[index] = newBulk(b)
+	}
+	if b == nil {
+		c.setNull(index)
+	} else if index/64 < len(c.nulls) {
+		c.nulls[index/64] &^= 1 << uint(index%64)
+	}
+	c.raw = nil
+}
+
+func (c *Command) setNull(index int) {
+	for len(c.nulls) <= index/64 {
+		c.nulls = append(c.nulls, 0)
+	}
+	c.nulls[index/64] |= 1 << uint(index%64)
+}
+
+// IsNull tells whether the argument at index is a null bulk ($-1) or null array (*-1), as opposed to an empty
+// string ($0). It's false for an index out of range.
+func (c *Command) IsNull(index int) bool {
+	if index < 0 || index >= len(c.argv) || index/64 >= len(c.nulls) {
+		return false
+	}
+	return c.nulls[index/64]&(1<<uint(index%64)) != 0
+}
+
+// Get returns the argument at index, nil when it's null or index is out of range. It points into the read
+// buffer and is only valid until the next ReadCommand, but its capacity ends with it so appending to an argument
+// copies it instead of overwriting the data following it. An empty bulk string ($0) is an empty, non-nil slice.
+func (c *Command) Get(index int) []byte {
+	if index >= 0 && index < len(c.argv) {
+		return c.argv[index]
+	} else {
+		return nil
+	}
+}
+
+// ArgAt returns the argument at index like Get, ok is false only when index is out of range so that a missing
+// argument can be told apart from a null one.
+func (c *Command) ArgAt(index int) ([]byte, bool) {
+	if index < 0 || index >= len(c.argv) {
+		return nil, false
+	}
+	return c.argv[index], true
+}
+
+// BulkString returns the argument at index as a string without copying it, for read-only lookups like map keys
+// on hot paths. The string shares memory with the parser's read buffer so it's only valid until the next
+// ReadCommand, like Get; it must not be retained or it will silently change. Use CopyString otherwise.
+func (c *Command) BulkString(index int) string {
+	arg := c.Get(index)
+	if len(arg) == 0 {
+		return ""
+	}
+	return *(*string)(unsafe.Pointer(&arg))
+}
+
+// CopyString returns the argument at index as a string, a copy that's safe to retain.
+func (c *Command) CopyString(index int) string {
+	return string(c.Get(index))
+}
+
+func (c *Command) ArgCount() int {
+	return len(c.argv)
+}
+
+// Name returns the command name, the first argument, or nil for an empty command.
+func (c *Command) Name() []byte {
+	return c.Get(0)
+}
+
+// EqualFold tells whether the argument at index equals s ignoring ASCII case, without allocating, e.g.
+// EqualFold(0, "get") to dispatch on the command name. It's false for an index out of range.
+func (c *Command) EqualFold(index int, s string) bool {
+	arg, ok := c.ArgAt(index)
+	if !ok || len(arg) != len(s) {
+		return false
+	}
+	for i := 0; i < len(arg); i++ {
+		a, b := arg[i], s[i]
+		if 'A' <= a && a <= 'Z' {
+			a += 'a' - 'A'
+		}
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// HasFlag tells whether one of the arguments after the command name equals name ignoring ASCII case, e.g.
+// HasFlag("nx") for SET k v EX 10 NX. A key or value spelled like the flag matches too, check positional
+// arguments by index first.
+func (c *Command) HasFlag(name string) bool {
+	for i := 1; i < len(c.argv); i++ {
+		if c.EqualFold(i, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// FlagValue returns the argument following the flag name (matched ignoring ASCII case), e.g. "10" for
+// FlagValue("ex") on SET k v EX 10 NX. ok is false when the flag is missing or is the last argument with no value.
+// A flag given more than once returns the value of the last one, and a value is never taken for a flag itself.
+func (c *Command) FlagValue(name string) (value []byte, ok bool) {
+	for i := 1; i+1 < len(c.argv); i++ {
+		if c.EqualFold(i, name) {
+			value, ok = c.argv[i+1], true
+			i++
+		}
+	}
+	return value, ok
+}
+
+// Equal tells whether c and other hold the same reply or command: type, integer value, arguments and nested
+// elements. A null argument only equals a null one, not an empty string. How they were read (inline or
+// multi-bulk, streamed or not) doesn't matter.
+func (c *Command) Equal(other *Command) bool {
+	if c.typ != other.typ || c.num != other.num || c.null != other.null || len(c.children) != len(other.children) {
+		return false
+	}
+	if len(c.argv) != len(other.argv) {
+		return false
+	}
+	for i, arg := range c.argv {
+		if c.IsNull(i) != other.IsNull(i) || !bytes.Equal(arg, other.argv[i]) {
+			return false
+		}
+	}
+	for i, child := range c.children {
+		if !child.Equal(other.children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualArgs tells whether the arguments of c are args, a nil arg matching a null argument only, e.g.
+// EqualArgs([]byte("SET"), []byte("k"), []byte("v")) in a test.
+func (c *Command) EqualArgs(args ...[]byte) bool {
+	if len(c.argv) != len(args) {
+		return false
+	}
+	for i, arg := range args {
+		if (arg == nil) != c.IsNull(i) || !bytes.Equal(c.argv[i], arg) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	fnvOffset = 14695981039346656037 // FNV-1a 64 bit parameters, see Digest
+	fnvPrime  = 1099511628211
+)
+
+// Digest returns a 64 bit FNV-1a hash of what Equal compares, e.g. as the key of a reply cache: commands that
+// are Equal have the same digest. Each argument is hashed along with its length, so ["GE", "TK"] and
+// ["GET", "K"] differ. It's no cryptographic hash, a client can craft collisions, so compare with Equal on a
+// digest match when that matters.
+func (c *Command) Digest() uint64 {
+	return c.digest(fnvOffset)
+}
+
+func (c *Command) digest(h uint64) uint64 {
+	h = fnvUint(h, uint64(c.typ))
+	h = fnvUint(h, uint64(c.num))
+	if c.null {
+		h = fnvUint(h, 1)
+	} else {
+		h = fnvUint(h, 0)
+	}
+	h = fnvUint(h, uint64(len(c.argv)))
+	for i, arg := range c.argv {
+		if c.IsNull(i) {
+			h = fnvUint(h, ^uint64(0)) // no length, unlike the empty string
+			continue
+		}
+		h = fnvUint(h, uint64(len(arg)))
+		for _, b := range arg {
+			h = (h ^ uint64(b)) * fnvPrime
+		}
+	}
+	h = fnvUint(h, uint64(len(c.children)))
+	for _, child := range c.children {
+		h = child.digest(h)
+	}
+	return h
+}
+
+// fnvUint hashes the 8 bytes of n into h.
+func fnvUint(h, n uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		h = (h ^ n&0xff) * fnvPrime
+		n >>= 8
+	}
+	return h
+}
+
+// IsPing tells whether the command is a PING, sent inline or as multi-bulk, e.g. to treat keep-alive traffic
+// separately from real commands.
+func (c *Command) IsPing() bool {
+	return c.typ == Multi && c.EqualFold(0, "ping")
+}
+
+// ExpectArgc returns an error wrapping ErrWrongArgc unless the command has exactly n arguments, counting the
+// command name like Redis arity does (GET key is 2). The error text is the Redis one, e.g.
+// "ERR wrong number of arguments for 'get' command".
+func (c *Command) ExpectArgc(n int) error {
+	return c.ExpectArgcRange(n, n)
+}
+
+// ExpectArgcRange works like ExpectArgc for a command taking min to max arguments, a negative max sets no
+// upper bound.
+func (c *Command) ExpectArgcRange(min, max int) error {
+	if n := len(c.argv); n < min || (max >= 0 && n > max) {
+		return &argcError{name: strings.ToLower(string(c.Name()))}
+	}
+	return nil
+}
+
+// Range returns the arguments from start up to (excluding) end, indices out of bounds are clamped rather
+// than panicking. Like Get, the arguments point into the parser's read buffer.
+func (c *Command) Range(start, end int) [][]byte {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(c.argv) {
+		end = len(c.argv)
+	}
+	if start >= end {
+		return nil
+	}
+	return c.argv[start:end:end]
+}
+
+// Args returns the arguments after the command name, see Range.
+func (c *Command) Args() [][]byte {
+	return c.Range(1, len(c.argv))
+}
+
+// ForEach calls fn for every argument, including the command name at index 0, until fn returns false.
+func (c *Command) ForEach(fn func(index int, arg []byte) bool) {
+	for i, arg := range c.argv {
+		if !fn(i, arg) {
+			return
+		}
+	}
+}
+
+// ForEachPair calls fn for every key/value pair of the arguments after the command name (e.g. MSET k v k v)
+// until fn returns false. It returns ErrOddPairs without calling fn if the arguments can't be paired.
+func (c *Command) ForEachPair(fn func(key, val []byte) bool) error {
+	if len(c.argv) == 0 || (len(c.argv)-1)%2 != 0 {
+		return ErrOddPairs
+	}
+	for i := 1; i < len(c.argv); i += 2 {
+		if !fn(c.argv[i], c.argv[i+1]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Type returns the frame type of the command, commands read from clients are always Multi. See
+// Parser.ReadFrame for streams mixing commands and replies.
+func (c *Command) Type() CommandType {
+	return c.typ
+}
+
+// IsNil is true for a null array (*-1) or a RESP3 null (_), it has no arguments like an empty array (*0) but
+// is a distinct value.
+func (c *Command) IsNil() bool {
+	return c.null
+}
+
+// Inline is true for a command sent as an inline (telnet) line rather than a RESP multi-bulk, both are Multi.
+func (c *Command) Inline() bool {
+	return c.inline
+}
+
+// IsError is true for an error reply, simple (-) or RESP3 blob error (!).
+func (c *Command) IsError() bool {
+	return c.typ == Error || c.typ == BlobError
+}
+
+// ErrorPrefix returns the error code leading an error reply, the first word when it's all uppercase, e.g.
+// "MOVED" for "-MOVED 3999 127.0.0.1:6381". It's empty for other replies or an error without a code.
+func (c *Command) ErrorPrefix() string {
+	if !c.IsError() {
+		return ""
+	}
+	msg := c.Get(0)
+	for i, ch := range msg {
+		if ch == ' ' {
+			return string(msg[:i])
+		}
+		if (ch < 'A' || ch > 'Z') && ch != '_' && (ch < '0' || ch > '9' || i == 0) {
+			return ""
+		}
+	}
+	return string(msg)
+}
+
+// Redirect decodes a cluster redirection error, "-MOVED 3999 127.0.0.1:6381" or "-ASK 3999 127.0.0.1:6381", into
+// its kind ("MOVED" or "ASK"), hash slot and node address. MOVED means the slot has moved for good, ASK only
+// redirects this one request, to be sent after ASKING. ok is false for any other reply or a malformed redirect.
+func (c *Command) Redirect() (kind string, slot int, addr string, ok bool) {
+	if c.typ != Error {
+		return "", 0, "", false
+	}
+	fields := strings.Split(string(c.Get(0)), " ")
+	if len(fields) != 3 || fields[0] != "MOVED" && fields[0] != "ASK" || fields[2] == "" {
+		return "", 0, "", false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= 16384 {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+// IsStreamed is true for a RESP3 streamed aggregate (*?) or streamed string ($?) read at the top level, the
+// elements or data are available through the normal accessors once the terminator has been read.
+func (c *Command) IsStreamed() bool {
+	return c.streamed
+}
+
+// Int returns the value of a Number command, or 1 and 0 for a true and false Boolean.
+func (c *Command) Int() int64 {
+	return c.num
+}
+
+// Children returns the elements of an aggregate (array, map, set, push or attribute) as commands, it's only populated when the array contains
+// elements other than bulk strings (integers, simple strings, errors or nested arrays); for an array of
+// bulk strings use Get/ArgCount. When populated, Get(i) still returns the payload of scalar elements and
+// nil for nested arrays.
+func (c *Command) Children() []*Command {
+	return c.children
+}
+
+// Copy returns a deep copy of the command, it's safe to retain after the next ReadCommand. The data is
+// allocated through ParserOptions.Allocator when the parser has one.
+func (c *Command) Copy() *Command {
+	return c.copy(c.alloc)
+}
+
+func (c *Command) copy(alloc Allocator) *Command {
+	var argv [][]byte
+	if c.argv != nil {
+		argv = make([][]byte, len(c.argv))
+		for i, arg := range c.argv {
+			if arg != nil {
+				argv[i] = copyBytes(alloc, arg)
+			}
+		}
+	}
+	var raw []byte
+	if c.raw != nil {
+		raw = copyBytes(alloc, c.raw)
+	}
+	var nulls []uint64
+	if c.nulls != nil {
+		nulls = append([]uint64(nil), c.nulls...)
+	}
+	var children []*Command
+	if c.children != nil {
+		children = make([]*Command, len(c.children))
+		for i, child := range c.children {
+			children[i] = child.copy(alloc)
+		}
+	}
+	return &Command{argv: argv, last: c.last, raw: raw, bytes: c.bytes, typ: c.typ, num: c.num, children: children,
+		null: c.null, nulls: nulls, streamed: c.streamed, alloc: alloc, inline: c.inline}
+}
+
+// CopyInto works like Copy but packs the argument data, children included, contiguously into dst[:0], growing
+// it if needed, and returns the copy along with the buffer to pass to the next call. Reusing one buffer this way
+// copies successive commands without allocating their data. The copy is only valid until dst is reused, and
+// Raw isn't copied.
+func (c *Command) CopyInto(dst []byte) (*Command, []byte) {
+	if n := c.dataLen(); cap(dst) < n {
+		dst = make([]byte, 0, n)
+	} else {
+		dst = dst[:0]
+	}
+	cmd := c.copyInto(&dst)
+	return cmd, dst
+}
+
+func (c *Command) dataLen() int {
+	n := 0
+	for _, arg := range c.argv {
+		n += len(arg)
+	}
+	for _, child := range c.children {
+		n += child.dataLen()
+	}
+	return n
+}
+
+// copyInto appends the data of c to dst, which has enough capacity for it so the copied arguments stay valid.
+func (c *Command) copyInto(dst *[]byte) *Command {
+	cmd := &Command{last: c.last, bytes: c.bytes, typ: c.typ, num: c.num, null: c.null, streamed: c.streamed,
+		alloc: c.alloc, inline: c.inline}
+	if c.argv != nil {
+		cmd.argv = make([][]byte, len(c.argv))
+		for i, arg := range c.argv {
+			if arg != nil {
+				begin := len(*dst)
+				*dst = append(*dst, arg...)
+				cmd.argv[i] = (*dst)[begin:len(*dst):len(*dst)]
+			}
+		}
+	}
+	if c.nulls != nil {
+		cmd.nulls = append([]uint64(nil), c.nulls...)
+	}
+	if c.children != nil {
+		cmd.children = make([]*Command, len(c.children))
+		for i, child := range c.children {
+			cmd.children[i] = child.copyInto(dst)
+		}
+	}
+	return cmd
+}
+
+func copyBytes(alloc Allocator, b []byte) []byte {
+	var dst []byte
+	if alloc != nil {
+		dst = alloc.Alloc(len(b))[:len(b):len(b)]
+	} else {
+		dst = make([]byte, len(b))
+	}
+	copy(dst, b)
+	return dst
+}
+
+// Len returns the number of bytes the command consumed from the stream.
+func (c *Command) Len() int {
+	return c.bytes
+}
+
+// Raw returns the wire bytes of the command exactly as received. Like Get, the returned slice points into the
+// parser's read buffer and is only valid until the next ReadCommand, use Copy to retain it. It's nil for a
+// command built with NewCommand or changed by AppendArg or SetArg.
+func (c *Command) Raw() []byte {
+	return c.raw
+}
+
+// Encode writes the command to w in RESP form, it's useful for forwarding the command upstream.
+// Multi commands are written as multi-bulk, the other types as the frame they were read from.
+func (c *Command) Encode(w io.Writer) (int, error) {
+	return w.Write(c.appendRESP(nil))
+}
+
+// WriteTo implements io.WriterTo for forwarding the command. It writes the same frames as Encode, inline commands
+// as multi-bulk too, but straight to w: arguments aren't copied into a buffer first.
+func (c *Command) WriteTo(w io.Writer) (int64, error) {
+	rw := respWriter{w: w}
+	c.writeRESP(&rw)
+	return rw.n, rw.err
+}
+
+// respWriter counts the bytes written and keeps the first error, after which it writes nothing.
+type respWriter struct {
+	w       io.Writer
+	n       int64
+	err     error
+	scratch [32]byte
+}
+
+func (w *respWriter) write(p []byte) {
+	if w.err == nil {
+		n, err := w.w.Write(p)
+		w.n += int64(n)
+		w.err = err
+	}
+}
+
+func (w *respWriter) writeHeader(typ byte, n int) {
+	dst := append(w.scratch[:0], typ)
+	dst = strconv.AppendInt(dst, int64(n), 10)
+	w.write(append(dst, newLine...))
+}
+
+func (w *respWriter) writeBulk(arg []byte) {
+	if arg == nil {
+		w.write(nilBulk)
+		return
+	}
+	w.writeHeader('$', len(arg))
+	w.write(arg)
+	w.write(newLine)
+}
+
+func (c *Command) writeRESP(w *respWriter) {
+	div := 1
+	if c.typ == Map || c.typ == Attribute {
+		div = 2
+	}
+	switch {
+	case c.typ == Bulk:
+		w.writeBulk(c.Get(0))
+	case c.typ == Status || c.typ == Error || c.typ == Double || c.typ == Boolean || c.typ == BigNumber:
+		w.write(append(w.scratch[:0], byte(c.typ)))
+		w.write(c.Get(0))
+		w.write(newLine)
+	case c.typ == Verbatim || c.typ == BlobError:
+		w.writeHeader(byte(c.typ), len(c.Get(0)))
+		w.write(c.Get(0))
+		w.write(newLine)
+	case !c.isAggregate() || c.null:
+		// numbers, nulls and null aggregates, short enough for the scratch buffer
+		w.write(c.appendRESP(w.scratch[:0]))
+	case c.children != nil:
+		w.writeHeader(byte(c.typ), len(c.children)/div)
+		for _, child := range c.children {
+			child.writeRESP(w)
+		}
+	default:
+		w.writeHeader(byte(c.typ), len(c.argv)/div)
+		for _, arg := range c.argv {
+			w.writeBulk(arg)
+		}
+	}
+}
+
+func (c *Command) appendRESP(dst []byte) []byte {
+	switch c.typ {
+	case Bulk:
+		return appendBulk(dst, c.Get(0))
+	case Number:
+		dst = append(dst, ':')
+		dst = strconv.AppendInt(dst, c.num, 10)
+		return append(dst, newLine...)
+	case Status, Error, Double, Boolean, BigNumber:
+		dst = append(dst, byte(c.typ))
+		dst = append(dst, c.Get(0)...)
+		return append(dst, newLine...)
+	case Null:
+		return append(dst, '_', '\r', '\n')
+	case Verbatim, BlobError:
+		dst = append(dst, byte(c.typ))
+		dst = strconv.AppendInt(dst, int64(len(c.Get(0))), 10)
+		dst = append(dst, newLine...)
+		dst = append(dst, c.Get(0)...)
+		return append(dst, newLine...)
+	}
+	if c.null && c.typ == Multi {
+		return append(dst, nilArray...)
+	}
+	dst = append(dst, byte(c.typ))
+	if c.null {
+		return append(dst, '-', '1', '\r', '\n')
+	}
+	div := 1
+	if c.typ == Map || c.typ == Attribute {
+		div = 2
+	}
+	if c.children != nil {
+		dst = strconv.AppendInt(dst, int64(len(c.children)/div), 10)
+		dst = append(dst, newLine...)
+		for _, child := range c.children {
+			dst = child.appendRESP(dst)
+		}
+		return dst
+	}
+	dst = strconv.AppendInt(dst, int64(len(c.argv)/div), 10)
+	dst = append(dst, newLine...)
+	for _, arg := range c.argv {
+		dst = appendBulk(dst, arg)
+	}
+	return dst
+}
+
+func appendBulk(dst []byte, arg []byte) []byte {
+	if arg == nil {
+		return append(dst, nilBulk...)
+	}
+	dst = append(dst, '$')
+	dst = strconv.AppendInt(dst, int64(len(arg)), 10)
+	dst = append(dst, newLine...)
+	dst = append(dst, arg...)
+	return append(dst, newLine...)
+}
+
+// String renders the command for logs and test failures as its type followed by the scalar value or the
+// arguments in brackets, e.g. "Multi [GET key]" or "Number 42". Non-printable bytes are hex escaped, arguments
+// longer than 64 bytes are truncated with "..." and null values show as (nil).
+func (c *Command) String() string {
+	return string(c.appendDump(make([]byte, 0, 64)))
+}
+
+func (c *Command) appendDump(dst []byte) []byte {
+	dst = append(dst, c.typ.String()...)
+	dst = append(dst, ' ')
+	switch {
+	case c.null:
+		return append(dst, "(nil)"...)
+	case c.typ == Number:
+		return strconv.AppendInt(dst, c.num, 10)
+	case !c.isAggregate():
+		return appendDumpArg(dst, c.Get(0))
+	}
+	dst = append(dst, '[')
+	if c.children != nil {
+		for i, child := range c.children {
+			if i > 0 {
+				dst = append(dst, ' ')
+			}
+			dst = child.appendDump(dst)
+		}
+	} else {
+		for i, arg := range c.argv {
+			if i > 0 {
+				dst = append(dst, ' ')
+			}
+			dst = appendDumpArg(dst, arg)
+		}
+	}
+	return append(dst, ']')
+}
+
+func (c *Command) isAggregate() bool {
+	switch c.typ {
+	case Multi, Map, Set, Push, Attribute:
+		return true
+	}
+	return false
+}
+
+func appendDumpArg(dst []byte, arg []byte) []byte {
+	if arg == nil {
+		return append(dst, "(nil)"...)
+	}
+	const hex = "0123456789abcdef"
+	for i, c := range arg {
+		if i == maxDumpArg {
+			return append(dst, "..."...)
+		}
+		switch {
+		case c == '\\':
+			dst = append(dst, '\\', '\\')
+		case c < ' ' || c >= 0x7f:
+			dst = append(dst, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// IsLast is true if this command is the last one in receive buffer, command handler should call writer.Flush()
+// after write response, helpful in process pipeline command.
+func (c *Command) IsLast() bool {
+	return c.last
+}
@@ -0,0 +1,404 @@
+package redisproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCommand_ForEach(t *testing.T) {
+	cmd, _ := NewParser(strings.NewReader("*4\r\n$3\r\nDEL\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n")).ReadCommand()
+	var keys []string
+	cmd.ForEach(func(index int, arg []byte) bool {
+		if index > 0 {
+			keys = append(keys, string(arg))
+		}
+		return index < 2
+	})
+	if strings.Join(keys, ",") != "a,b" {
+		t.Errorf("Unexpected iteration %v", keys)
+	}
+}
+
+func TestCommand_ForEachPair(t *testing.T) {
+	cmd, _ := NewParser(strings.NewReader("*5\r\n$4\r\nMSET\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n")).ReadCommand()
+	var pairs []string
+	err := cmd.ForEachPair(func(key, val []byte) bool {
+		pairs = append(pairs, string(key)+"="+string(val))
+		return true
+	})
+	if err != nil || strings.Join(pairs, ",") != "a=1,b=2" {
+		t.Errorf("Unexpected pairs %v %v", pairs, err)
+	}
+	cmd, _ = NewParser(strings.NewReader("*2\r\n$4\r\nMSET\r\n$1\r\na\r\n")).ReadCommand()
+	if err = cmd.ForEachPair(func(key, val []byte) bool { return true }); err != ErrOddPairs {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestCommand_IsNull(t *testing.T) {
+	cmd, err := NewParser(strings.NewReader("*4\r\n$4\r\nHSET\r\n$-1\r\n$0\r\n\r\n$3\r\nabc\r\n")).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cmd.IsNull(0) || !cmd.IsNull(1) || cmd.IsNull(2) || cmd.IsNull(3) || cmd.IsNull(4) {
+		t.Errorf("Unexpected nullness")
+	}
+	if len(cmd.Get(2)) != 0 || string(cmd.Get(3)) != "abc" {
+		t.Errorf("Unexpected arguments")
+	}
+	if copied := cmd.Copy(); !copied.IsNull(1) || copied.IsNull(2) {
+		t.Errorf("Unexpected nullness of copy")
+	}
+}
+
+func TestCommand_ArgAt(t *testing.T) {
+	cmd, _ := NewParser(strings.NewReader("*3\r\n$5\r\nSETEX\r\n$1\r\nk\r\n$-1\r\n")).ReadCommand()
+	if arg, ok := cmd.ArgAt(2); !ok || arg != nil {
+		t.Errorf("Unexpected null argument %q %v", arg, ok)
+	}
+	if arg, ok := cmd.ArgAt(1); !ok || string(arg) != "k" {
+		t.Errorf("Unexpected argument %q %v", arg, ok)
+	}
+	if _, ok := cmd.ArgAt(3); ok {
+		t.Errorf("Unexpected argument out of range")
+	}
+	if _, ok := cmd.ArgAt(-1); ok {
+		t.Errorf("Unexpected negative index")
+	}
+}
+
+type arena struct {
+	buf   []byte
+	calls int
+}
+
+func (a *arena) Alloc(n int) []byte {
+	a.calls++
+	b := a.buf[len(a.buf) : len(a.buf)+n]
+	a.buf = a.buf[:len(a.buf)+n]
+	return b
+}
+
+func TestCommand_CopyAllocator(t *testing.T) {
+	a := &arena{buf: make([]byte, 0, 256)}
+	input := "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{Allocator: a})
+	cmd, err := parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	copied := cmd.Copy()
+	if a.calls != 3 || string(a.buf) != "GETk"+input {
+		t.Errorf("Unexpected allocations %d %q", a.calls, a.buf)
+	}
+	if string(copied.Get(0)) != "GET" || string(copied.Get(1)) != "k" || string(copied.Raw()) != input {
+		t.Errorf("Unexpected copy %q", copied.Args())
+	}
+}
+
+func TestCommand_Inline(t *testing.T) {
+	parser := NewParser(strings.NewReader("PING\r\n*1\r\n$4\r\nPING\r\n"))
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.Inline() || !cmd.Copy().Inline() {
+		t.Errorf("Expected an inline command %v", err)
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.Inline() {
+		t.Errorf("Expected a multi-bulk command %v", err)
+	}
+}
+
+func TestCommand_ExpectArgc(t *testing.T) {
+	cmd, _ := NewParser(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")).ReadCommand()
+	if string(cmd.Name()) != "GET" || cmd.ExpectArgc(2) != nil || cmd.ExpectArgcRange(2, -1) != nil {
+		t.Errorf("Unexpected arity check failure")
+	}
+	err := cmd.ExpectArgc(3)
+	if !errors.Is(err, ErrWrongArgc) || err.Error() != "ERR wrong number of arguments for 'get' command" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if cmd.ExpectArgcRange(3, -1) == nil || cmd.ExpectArgcRange(0, 1) == nil {
+		t.Errorf("Expected range errors")
+	}
+}
+
+func TestCommand_CopyInto(t *testing.T) {
+	parser := NewParser(strings.NewReader("*2\r\n:1\r\n$2\r\nab\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$-1\r\n"))
+	var scratch []byte
+	cmd, _ := parser.ReadCommand()
+	copied, scratch := cmd.CopyInto(scratch)
+	if copied.Children()[0].Int() != 1 || string(copied.Children()[1].Get(0)) != "ab" || string(copied.Get(1)) != "ab" {
+		t.Errorf("Unexpected copy of array %q", scratch)
+	}
+	buf := scratch
+	cmd, _ = parser.ReadCommand()
+	copied, scratch = cmd.CopyInto(scratch)
+	if &scratch[0] != &buf[0] || string(scratch) != "SETk" || string(copied.Get(1)) != "k" || !copied.IsNull(2) {
+		t.Errorf("Unexpected copy %q", scratch)
+	}
+}
+
+func BenchmarkCommand_Copy(b *testing.B) {
+	cmd, _ := NewParser(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")).ReadCommand()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cmd.Copy()
+	}
+}
+
+func BenchmarkCommand_CopyInto(b *testing.B) {
+	cmd, _ := NewParser(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")).ReadCommand()
+	var scratch []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, scratch = cmd.CopyInto(scratch)
+	}
+}
+
+func TestCommand_String(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$2\r\n\x00\\\r\n$-1\r\n:42\r\n+OK\r\n*2\r\n:1\r\n*1\r\n$1\r\na\r\n*-1\r\n$100\r\n" +
+		strings.Repeat("x", 100) + "\r\n"
+	expect := []string{
+		`Multi [SET \x00\\ (nil)]`,
+		"Number 42",
+		"Status OK",
+		"Multi [Number 1 Multi [a]]",
+		"Multi (nil)",
+		"Bulk " + strings.Repeat("x", 64) + "...",
+	}
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{MaxBulkSize: 1000, Mode: ModeClient})
+	for _, e := range expect {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if cmd.String() != e {
+			t.Errorf("Unexpected String %q, expect %q", cmd.String(), e)
+		}
+	}
+}
+
+func TestCommand_IsPing(t *testing.T) {
+	parser := NewParser(strings.NewReader("ping\r\n*2\r\n$4\r\nPiNg\r\n$2\r\nhi\r\n*1\r\n$4\r\nPONG\r\n+PING\r\n"))
+	for i, expect := range []bool{true, true, false, false} {
+		cmd, err := parser.ReadCommand()
+		if err != nil || cmd.IsPing() != expect {
+			t.Errorf("Unexpected IsPing of command %d %v", i, err)
+		}
+	}
+	cmd, _ := NewParser(strings.NewReader("GET k\r\n")).ReadCommand()
+	if !cmd.EqualFold(0, "get") || !cmd.EqualFold(1, "K") || cmd.EqualFold(1, "kk") || cmd.EqualFold(2, "") {
+		t.Errorf("Unexpected EqualFold")
+	}
+	if n := testing.AllocsPerRun(100, func() { cmd.IsPing() }); n != 0 {
+		t.Errorf("Unexpected allocations %v", n)
+	}
+}
+
+func TestCommand_ErrorPrefix(t *testing.T) {
+	parser := newReplyParser(strings.NewReader("-MOVED 3999 127.0.0.1:6381\r\n-WRONGTYPE Operation\r\n-NOAUTH\r\n-bad thing\r\n+OK\r\n"))
+	for _, expect := range []string{"MOVED", "WRONGTYPE", "NOAUTH", "", ""} {
+		cmd, err := parser.ReadCommand()
+		if err != nil || cmd.IsError() != (cmd.Type() == Error) || cmd.ErrorPrefix() != expect {
+			t.Errorf("Unexpected prefix %q of %v, expect %q", cmd.ErrorPrefix(), cmd, expect)
+		}
+	}
+}
+
+func TestCommand_BulkString(t *testing.T) {
+	cmd, _ := NewParser(strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")).ReadCommand()
+	if cmd.BulkString(1) != "key" || cmd.CopyString(1) != "key" || cmd.BulkString(2) != "" || cmd.CopyString(-1) != "" {
+		t.Errorf("Unexpected strings")
+	}
+	kept := cmd.CopyString(1)
+	cmd.Get(1)[0] = 'K'
+	if cmd.BulkString(1) != "Key" || kept != "key" {
+		t.Errorf("Unexpected aliasing %q %q", cmd.BulkString(1), kept)
+	}
+}
+
+func benchmarkLookup(b *testing.B, key func(*Command) string) {
+	cmd, _ := NewParser(strings.NewReader("*2\r\n$3\r\nGET\r\n$10\r\nuser:12345\r\n")).ReadCommand()
+	m := map[string]int{"user:12345": 1}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if m[key(cmd)] != 1 {
+			b.Fatal("missing key")
+		}
+	}
+}
+
+func BenchmarkCommand_LookupBulkString(b *testing.B) {
+	benchmarkLookup(b, func(c *Command) string { return c.BulkString(1) })
+}
+
+func BenchmarkCommand_LookupCopyString(b *testing.B) {
+	benchmarkLookup(b, func(c *Command) string { return c.CopyString(1) })
+}
+
+func TestCommand_Range(t *testing.T) {
+	cmd, _ := NewParser(strings.NewReader("SORT k LIMIT 0 10\r\n")).ReadCommand()
+	if args := cmd.Args(); len(args) != 4 || string(args[0]) != "k" {
+		t.Errorf("Unexpected Args %q", args)
+	}
+	if r := cmd.Range(2, 4); len(r) != 2 || string(r[0]) != "LIMIT" || string(r[1]) != "0" {
+		t.Errorf("Unexpected Range %q", r)
+	}
+	if r := cmd.Range(-3, 100); len(r) != 5 {
+		t.Errorf("Unexpected clamped Range %q", r)
+	}
+	if r := cmd.Range(4, 2); r != nil {
+		t.Errorf("Unexpected empty Range %q", r)
+	}
+	cmd, _ = NewParser(strings.NewReader("PING\r\n")).ReadCommand()
+	if args := cmd.Args(); len(args) != 0 {
+		t.Errorf("Unexpected Args %q", args)
+	}
+}
+
+func TestCommand_Redirect(t *testing.T) {
+	for input, expect := range map[string]string{
+		"-MOVED 3999 127.0.0.1:6381\r\n":     "MOVED 3999 127.0.0.1:6381 true",
+		"-ASK 3999 127.0.0.1:6381\r\n":       "ASK 3999 127.0.0.1:6381 true",
+		"-MOVED 16384 127.0.0.1:6381\r\n":    " 0  false",
+		"-MOVED x 127.0.0.1:6381\r\n":        " 0  false",
+		"-MOVED 3999\r\n":                    " 0  false",
+		"-ERR MOVED 3999 127.0.0.1:6381\r\n": " 0  false",
+		"+MOVED 3999 127.0.0.1:6381\r\n":     " 0  false",
+	} {
+		cmd, err := newReplyParser(strings.NewReader(input)).ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		kind, slot, addr, ok := cmd.Redirect()
+		if got := fmt.Sprintf("%s %d %s %v", kind, slot, addr, ok); got != expect {
+			t.Errorf("Unexpected redirect %q for %q", got, input)
+		}
+	}
+}
+
+func TestCommand_Flags(t *testing.T) {
+	cmd, _ := NewParser(strings.NewReader("SET k v EX 10 NX\r\n")).ReadCommand()
+	if v, ok := cmd.FlagValue("ex"); !ok || string(v) != "10" {
+		t.Errorf("Unexpected EX %q %v", v, ok)
+	}
+	if !cmd.HasFlag("nx") || !cmd.HasFlag("EX") || cmd.HasFlag("xx") || cmd.HasFlag("set") {
+		t.Errorf("Unexpected flags")
+	}
+	if v, ok := cmd.FlagValue("nx"); ok {
+		t.Errorf("Unexpected value %q for a trailing flag", v)
+	}
+	cmd, _ = NewParser(strings.NewReader("SET k v PX px PX 20 PX\r\n")).ReadCommand()
+	if v, ok := cmd.FlagValue("px"); !ok || string(v) != "20" {
+		t.Errorf("Unexpected PX %q %v", v, ok)
+	}
+}
+
+func TestCommand_NewCommand(t *testing.T) {
+	cmd := NewCommand([]byte("SET"), []byte("k"), nil)
+	cmd.AppendArg([]byte("NX"))
+	if cmd.ArgCount() != 4 || string(cmd.Name()) != "SET" || !cmd.IsNull(2) || cmd.IsNull(3) || cmd.Raw() != nil {
+		t.Fatalf("Unexpected command %v", cmd)
+	}
+	cmd.SetArg(2, []byte("v"))
+	buff := bytes.NewBuffer(nil)
+	cmd.Encode(buff)
+	if buff.String() != "*4\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n$2\r\nNX\r\n" {
+		t.Fatalf("Unexpected encoding %q", buff.String())
+	}
+
+	// rewrite a parsed command like a proxy adding a key prefix
+	parsed, _ := NewParser(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")).ReadCommand()
+	parsed.SetArg(1, append([]byte("app:"), parsed.Get(1)...))
+	parsed.AppendArg(nil)
+	buff.Reset()
+	parsed.Encode(buff)
+	if parsed.Raw() != nil || buff.String() != "*3\r\n$3\r\nGET\r\n$5\r\napp:k\r\n$-1\r\n" {
+		t.Errorf("Unexpected rewritten command %q", buff.String())
+	}
+}
+
+func TestCommand_Equal(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\nPING\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$-1\r\n" +
+		"*2\r\n:1\r\n*1\r\n+a\r\n*2\r\n:1\r\n*1\r\n+b\r\n"
+	cmds, err := ReadAll(strings.NewReader(input))
+	if err != nil || len(cmds) != 5 {
+		t.Fatalf("Unexpected commands %v %v", cmds, err)
+	}
+	if !cmds[0].Equal(NewCommand([]byte("SET"), []byte("k"), []byte{})) || cmds[0].Equal(cmds[2]) || cmds[3].Equal(cmds[4]) {
+		t.Errorf("Unexpected equality")
+	}
+	if !cmds[3].Equal(cmds[3].Copy()) || !cmds[2].Equal(NewCommand([]byte("SET"), []byte("k"), nil)) {
+		t.Errorf("Expect commands to be equal")
+	}
+	if !cmds[0].EqualArgs([]byte("SET"), []byte("k"), []byte{}) || cmds[0].EqualArgs([]byte("SET"), []byte("k"), nil) ||
+		!cmds[2].EqualArgs([]byte("SET"), []byte("k"), nil) || cmds[0].EqualArgs([]byte("SET"), []byte("k")) {
+		t.Errorf("Unexpected argument equality")
+	}
+}
+
+func TestCommand_Digest(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$1\r\nK\r\nGET K\r\n*2\r\n$2\r\nGE\r\n$2\r\nTK\r\n*2\r\n$3\r\nGET\r\n$-1\r\n" +
+		"*2\r\n$3\r\nGET\r\n$0\r\n\r\n*2\r\n:1\r\n*1\r\n+a\r\n*2\r\n:1\r\n*1\r\n+b\r\n"
+	cmds, err := ReadAll(strings.NewReader(input))
+	if err != nil || len(cmds) != 7 {
+		t.Fatalf("Unexpected commands %v %v", cmds, err)
+	}
+	if cmds[0].Digest() != cmds[1].Digest() || cmds[0].Digest() != NewCommand([]byte("GET"), []byte("K")).Digest() ||
+		cmds[5].Digest() != cmds[5].Copy().Digest() {
+		t.Errorf("Expect equal commands to have the same digest")
+	}
+	seen := map[uint64]int{}
+	for i, cmd := range append(cmds[1:], NewCommand([]byte("GET"))) {
+		if j, ok := seen[cmd.Digest()]; ok {
+			t.Errorf("Unexpected digest collision of %v and %v", cmd, cmds[j+1])
+		}
+		seen[cmd.Digest()] = i
+	}
+}
+
+func TestCommand_WriteTo(t *testing.T) {
+	input := "SET a b\r\n*3\r\n$3\r\nSET\r\n$-1\r\n$0\r\n\r\n*2\r\n*1\r\n:1\r\n+OK\r\n$2\r\nhi\r\n*-1\r\n" +
+		"%1\r\n+k\r\n,1.5\r\n"
+	parser := NewParser(strings.NewReader(input))
+	parser.SetProtocolVersion(3)
+	var _ io.WriterTo = (*Command)(nil)
+	for i := 0; i < 6; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		var encoded, buff bytes.Buffer
+		cmd.Encode(&encoded)
+		n, err := cmd.WriteTo(&buff)
+		if err != nil || n != int64(buff.Len()) || buff.String() != encoded.String() {
+			t.Fatalf("Unexpected output %q %d %v", buff.String(), n, err)
+		}
+		again := NewParser(&buff)
+		again.SetProtocolVersion(3)
+		if forwarded, err := again.ReadCommand(); err != nil || forwarded.String() != cmd.String() {
+			t.Errorf("Unexpected forwarded command %v %v", forwarded, err)
+		}
+	}
+}
+
+func TestCommand_WriteToScalars(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	input := "+" + long + "\r\n-ERR " + long + "\r\n:-12\r\n_\r\n#t\r\n,1.5\r\n(12345\r\n" +
+		"=104\r\ntxt:" + long + "\r\n!103\r\nERR" + long + "\r\n"
+	parser := resp3(newReplyParser(strings.NewReader(input)))
+	for i := 0; i < 9; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		var encoded, buff bytes.Buffer
+		cmd.Encode(&encoded)
+		n, err := cmd.WriteTo(&buff)
+		if err != nil || n != int64(buff.Len()) || buff.String() != encoded.String() {
+			t.Fatalf("Unexpected output %q %d %v, expected %q", buff.String(), n, err, encoded.String())
+		}
+	}
+}
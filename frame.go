@@ -0,0 +1,60 @@
+package redisproto
+
+import (
+	"errors"
+)
+
+// errNeedMore is returned by the reader of a FrameParser when the data fed so far is consumed.
+var errNeedMore = errors.New("redisproto: need more data")
+
+// FrameParser parses commands out of data pushed to it rather than read from an io.Reader, for transports
+// delivering RESP in frames of their own like WebSocket messages or queue records. A command can span frames
+// and a frame can hold several commands.
+type FrameParser struct {
+	parser *Parser
+	source frameSource
+}
+
+// frameSource serves the data fed to a FrameParser to its parser.
+type frameSource struct {
+	data []byte
+	pos  int
+}
+
+func (s *frameSource) Read(p []byte) (int, error) {
+	if s.pos == len(s.data) {
+		s.data, s.pos = s.data[:0], 0
+		return 0, errNeedMore
+	}
+	n := copy(p, s.data[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+// NewFrameParser creates a FrameParser, opts apply like for NewParserWithOptions (ReadTimeout excluded).
+func NewFrameParser(opts ParserOptions) *FrameParser {
+	f := &FrameParser{}
+	f.parser = NewParserWithOptions(&f.source, opts)
+	return f
+}
+
+// Feed appends a frame to the data to parse, it's copied so the caller can reuse it.
+func (f *FrameParser) Feed(frame []byte) {
+	f.source.data = append(f.source.data, frame...)
+}
+
+// Next returns the next command of the data fed so far, or nil with a nil error when the data doesn't hold a
+// complete command: a command cut by the end of a frame is kept and returned once the rest of it is fed.
+// Errors are those of Parser.ReadCommand, io.EOF excepted. The command is only valid until the next call.
+func (f *FrameParser) Next() (*Command, error) {
+	cmd, err := f.parser.ReadCommand()
+	if err == errNeedMore {
+		return nil, nil
+	}
+	return cmd, err
+}
+
+// Buffered returns the number of bytes fed but not parsed into commands yet.
+func (f *FrameParser) Buffered() int {
+	return f.parser.Buffered() + len(f.source.data) - f.source.pos
+}
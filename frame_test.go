@@ -0,0 +1,57 @@
+package redisproto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFrameParser_Split(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\nPING\r\n*3\r\n$3\r\nSET\r\n$0\r\n\r\n$-1\r\n"
+	expect := []string{"Multi [GET key]", "Multi [PING]", "Multi [SET  (nil)]"}
+	// every way to cut the input in three frames
+	for i := 0; i <= len(input); i++ {
+		for j := i; j <= len(input); j++ {
+			f := NewFrameParser(ParserOptions{})
+			var got []string
+			for _, frame := range []string{input[:i], input[i:j], input[j:]} {
+				f.Feed([]byte(frame))
+				for {
+					cmd, err := f.Next()
+					if err != nil {
+						t.Fatalf("Unexpected error %v at %d %d", err, i, j)
+					}
+					if cmd == nil {
+						break
+					}
+					got = append(got, cmd.String())
+				}
+			}
+			if len(got) != len(expect) || got[0] != expect[0] || got[1] != expect[1] || got[2] != expect[2] {
+				t.Fatalf("Unexpected commands %q at %d %d", got, i, j)
+			}
+			if f.Buffered() != 0 {
+				t.Fatalf("Unexpected buffered %d", f.Buffered())
+			}
+		}
+	}
+}
+
+func TestFrameParser_Partial(t *testing.T) {
+	var errs int
+	f := NewFrameParser(ParserOptions{OnError: func(err error) { errs++ }})
+	f.Feed([]byte("*2\r\n$3\r\nGET\r\n$3\r\nke"))
+	if cmd, err := f.Next(); cmd != nil || err != nil {
+		t.Fatalf("Unexpected result %v %v", cmd, err)
+	}
+	if f.Buffered() != 19 {
+		t.Errorf("Unexpected buffered %d", f.Buffered())
+	}
+	f.Feed([]byte("y\r\n"))
+	if cmd, err := f.Next(); err != nil || string(cmd.Get(1)) != "key" {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	f.Feed([]byte("*1\r\n$x\r\n"))
+	if _, err := f.Next(); !errors.Is(err, ExpectNumber) || errs != 1 {
+		t.Errorf("Unexpected error %v, %d errors reported", err, errs)
+	}
+}
@@ -0,0 +1,67 @@
+package redisproto
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+func FuzzReadCommand(f *testing.F) {
+	for _, seed := range []string{
+		"*1\r\n$4\r\nPING\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$-1\r\n",
+		"*2\r\n*1\r\n:1\r\n+OK\r\n",
+		"*?\r\n$?\r\n;1\r\na\r\n;0\r\n.\r\n",
+		"PING\r\n",
+		"\n",
+		"\r\n",
+		"$-1\r\n",
+		"-ERR x\r\n",
+		":-\r\n",
+		"%1\r\n|1\r\n+a\r\n#t\r\n=5\r\ntxt:x\r\n,1.5\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzParser(t, data, NewParser(bytes.NewReader(data)))
+		parser := NewParserWithOptions(iotest.OneByteReader(bytes.NewReader(data)),
+			ParserOptions{LenientNewline: true, StrictInline: true, MaxBufferSize: 64})
+		parser.SetProtocolVersion(3)
+		fuzzParser(t, data, parser)
+		fuzzFastPath(t, data)
+	})
+}
+
+// fuzzFastPath checks the single pass parser gives the same results as the general one, which MaxCommandBytes
+// switches to.
+func fuzzFastPath(t *testing.T, data []byte) {
+	fast := NewParser(bytes.NewReader(data))
+	general := NewParserWithOptions(bytes.NewReader(data), ParserOptions{MaxCommandBytes: 1 << 30})
+	for i := 0; i <= len(data); i++ {
+		fcmd, ferr := fast.ReadCommand()
+		gcmd, gerr := general.ReadCommand()
+		if (ferr == nil) != (gerr == nil) || ferr != nil && ferr.Error() != gerr.Error() {
+			t.Fatalf("Unexpected errors %v %v", ferr, gerr)
+		}
+		if ferr != nil {
+			return
+		}
+		if fcmd.String() != gcmd.String() || fcmd.Len() != gcmd.Len() {
+			t.Fatalf("Unexpected commands %v %v", fcmd, gcmd)
+		}
+	}
+}
+
+func fuzzParser(t *testing.T, data []byte, parser *Parser) {
+	// every successful command consumes at least one byte, so this bound is never reached unless it hangs
+	for i := 0; i <= len(data); i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			return
+		}
+		if cmd == nil {
+			t.Fatalf("nil command without error")
+		}
+	}
+	t.Fatalf("parser made no progress")
+}
@@ -0,0 +1,279 @@
+package redisproto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+var (
+	percent = []byte{'%'}
+	boolT   = []byte{'#', 't', '\r', '\n'}
+	boolF   = []byte{'#', 'f', '\r', '\n'}
+)
+
+// Marshal writes v to w as a RESP reply. string and []byte are written as bulk strings, integers as ':' integers,
+// bool as a RESP3 boolean, nil as a null bulk, error as an error reply, []interface{} as an array and
+// map[string]interface{} as a RESP3 map (keys sorted). Other types are written as an "-ERR" reply in place, so the
+// stream stays well-formed, and reported by the returned error. The elements of an array or map after an
+// unsupported one are still written, the first such error is returned at the end.
+func Marshal(w io.Writer, v interface{}) error {
+	return marshal(NewWriter(w), v)
+}
+
+// unsupportedTypeError reports a value Marshal wrote as an error reply, unlike a write error it leaves the
+// stream in sync so marshalling goes on with the next element.
+type unsupportedTypeError struct {
+	value interface{}
+}
+
+func (e *unsupportedTypeError) Error() string {
+	return fmt.Sprintf("unsupported type %T", e.value)
+}
+
+// marshalElement marshals an element of an aggregate, it keeps the first unsupported type error in first and
+// returns any other error.
+func marshalElement(w *Writer, v interface{}, first *error) error {
+	err := marshal(w, v)
+	if _, ok := err.(*unsupportedTypeError); ok {
+		if *first == nil {
+			*first = err
+		}
+		return nil
+	}
+	return err
+}
+
+func marshal(w *Writer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return w.WriteBulk(nil)
+	case string:
+		return w.WriteBulkString(v)
+	case []byte:
+		return w.WriteBulk(v)
+	case int:
+		return w.WriteInt(int64(v))
+	case int32:
+		return w.WriteInt(int64(v))
+	case int64:
+		return w.WriteInt(v)
+	case bool:
+		if v {
+			_, err := w.Write(boolT)
+			return err
+		}
+		_, err := w.Write(boolF)
+		return err
+	case error:
+		return w.WriteError(v.Error())
+	case []interface{}:
+		if v == nil {
+			return w.WriteNullArray()
+		}
+		w.WriteArrayHeader(len(v))
+		var first error
+		for _, e := range v {
+			if err := marshalElement(w, e, &first); err != nil {
+				return err
+			}
+		}
+		return first
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.Write(percent)
+		w.Write(strconv.AppendInt(nil, int64(len(keys)), 10))
+		w.Write(newLine)
+		var first error
+		for _, k := range keys {
+			if err := w.WriteBulkString(k); err != nil {
+				return err
+			}
+			if err := marshalElement(w, v[k], &first); err != nil {
+				return err
+			}
+		}
+		return first
+	}
+	if err := w.WriteError(fmt.Sprintf("ERR unsupported type %T", v)); err != nil {
+		return err
+	}
+	return &unsupportedTypeError{value: v}
+}
+
+// ErrNil is returned by Unmarshal when the reply is a null bulk or null array and the target can't hold nil.
+var ErrNil = errors.New("redisproto: nil reply")
+
+// Unmarshal decodes a parsed reply into the value pointed to by v. Supported targets are *string, *[]byte,
+// *int64, *[]string, *[]interface{}, *map[string]string (from an array of alternating keys and values) and
+// *interface{}. Decoding into *interface{} maps bulk strings to []byte, simple strings to string, integers to
+// int64, error replies to error and arrays to []interface{}. Data is copied out so it stays valid after the
+// next ReadCommand. An error reply decoded into anything but *interface{} is returned as the error.
+// RESP3 replies decode as their RESP2 counterparts: verbatim strings, doubles and big numbers like simple
+// strings (into *interface{} as string, float64 and string), booleans into *interface{} as bool, nulls as nil,
+// blob errors as errors, sets and pushes as arrays and maps into *map[string]string or, into *interface{}, as
+// map[string]interface{} keyed by the keys' payload.
+func (c *Command) Unmarshal(v interface{}) error {
+	if c.typ == Error || c.typ == BlobError {
+		if p, ok := v.(*interface{}); ok {
+			*p = errors.New(string(c.Get(0)))
+			return nil
+		}
+		return errors.New(string(c.Get(0)))
+	}
+	switch p := v.(type) {
+	case *interface{}:
+		*p = c.value()
+		return nil
+	case *string:
+		if c.isNull() {
+			return ErrNil
+		}
+		switch c.typ {
+		case Bulk, Status, Verbatim, Double, BigNumber:
+			*p = string(c.Get(0))
+			return nil
+		case Number:
+			*p = strconv.FormatInt(c.num, 10)
+			return nil
+		}
+	case *[]byte:
+		if c.isNull() {
+			*p = nil
+			return nil
+		}
+		switch c.typ {
+		case Bulk, Status, Verbatim, Double, BigNumber:
+			*p = append([]byte(nil), c.Get(0)...)
+			return nil
+		}
+	case *int64:
+		switch c.typ {
+		case Number:
+			*p = c.num
+			return nil
+		case Bulk:
+			n, err := strconv.ParseInt(string(c.Get(0)), 10, 64)
+			if err != nil {
+				return fmt.Errorf("redisproto: cannot unmarshal %q into %T", c.Get(0), v)
+			}
+			*p = n
+			return nil
+		}
+	case *[]string:
+		if c.isArray() {
+			if c.null {
+				*p = nil
+				return nil
+			}
+			elements := c.elements()
+			s := make([]string, len(elements))
+			for i, e := range elements {
+				if err := e.Unmarshal(&s[i]); err != nil {
+					return err
+				}
+			}
+			*p = s
+			return nil
+		}
+	case *[]interface{}:
+		if c.isArray() {
+			if c.null {
+				*p = nil
+				return nil
+			}
+			*p = c.value().([]interface{})
+			return nil
+		}
+	case *map[string]string:
+		if c.isArray() || c.typ == Map {
+			if c.null {
+				*p = nil
+				return nil
+			}
+			elements := c.elements()
+			if len(elements)%2 != 0 {
+				return fmt.Errorf("redisproto: cannot unmarshal array of %d elements into %T", len(elements), v)
+			}
+			m := make(map[string]string, len(elements)/2)
+			for i := 0; i < len(elements); i += 2 {
+				var key, val string
+				if err := elements[i].Unmarshal(&key); err != nil {
+					return err
+				}
+				if err := elements[i+1].Unmarshal(&val); err != nil {
+					return err
+				}
+				m[key] = val
+			}
+			*p = m
+			return nil
+		}
+	default:
+		return fmt.Errorf("redisproto: unsupported unmarshal target %T", v)
+	}
+	return fmt.Errorf("redisproto: cannot unmarshal '%c' reply into %T", byte(c.typ), v)
+}
+
+func (c *Command) isArray() bool {
+	return c.typ == Multi || c.typ == Set || c.typ == Push
+}
+
+func (c *Command) isNull() bool {
+	return c.null || (c.typ == Bulk && c.IsNull(0))
+}
+
+// elements returns the elements of an array as commands whether or not children were populated while parsing.
+func (c *Command) elements() []*Command {
+	if c.children != nil {
+		return c.children
+	}
+	elements := make([]*Command, len(c.argv))
+	for i := range c.argv {
+		elements[i] = newBulk(c.argv[i])
+	}
+	return elements
+}
+
+func (c *Command) value() interface{} {
+	switch c.typ {
+	case Bulk:
+		if c.Get(0) == nil {
+			return nil
+		}
+		return append([]byte(nil), c.Get(0)...)
+	case Status, Verbatim, BigNumber:
+		return string(c.Get(0))
+	case Error, BlobError:
+		return errors.New(string(c.Get(0)))
+	case Number:
+		return c.num
+	case Double:
+		f, _ := strconv.ParseFloat(string(c.Get(0)), 64)
+		return f
+	case Boolean:
+		return c.num == 1
+	}
+	if c.null {
+		return nil
+	}
+	elements := c.elements()
+	if c.typ == Map || c.typ == Attribute {
+		m := make(map[string]interface{}, len(elements)/2)
+		for i := 0; i+1 < len(elements); i += 2 {
+			m[string(elements[i].Get(0))] = elements[i+1].value()
+		}
+		return m
+	}
+	values := make([]interface{}, len(elements))
+	for i, e := range elements {
+		values[i] = e.value()
+	}
+	return values
+}
@@ -0,0 +1,92 @@
+package redisproto
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	err := Marshal(buff, []interface{}{"a", []byte("b"), 1, int64(-2), true, nil, errors.New("ERR oops"),
+		map[string]interface{}{"y": false, "x": []interface{}{}}})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expect := "*8\r\n$1\r\na\r\n$1\r\nb\r\n:1\r\n:-2\r\n#t\r\n$-1\r\n-ERR oops\r\n%2\r\n$1\r\nx\r\n*0\r\n$1\r\ny\r\n#f\r\n"
+	if buff.String() != expect {
+		t.Errorf("Unexpected Marshal %q", buff.String())
+	}
+}
+
+func TestMarshal_Unsupported(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	if err := Marshal(buff, []interface{}{1.5}); err == nil {
+		t.Errorf("Expect error on unsupported type")
+	}
+	if buff.String() != "*1\r\n-ERR unsupported type float64\r\n" {
+		t.Errorf("Unexpected Marshal %q", buff.String())
+	}
+	// the elements after an unsupported one are still written, the stream stays in sync
+	buff.Reset()
+	err := Marshal(buff, []interface{}{struct{}{}, "x", []interface{}{1.5, 2}, map[string]interface{}{"a": 1.5, "b": 1}})
+	if err == nil || err.Error() != "unsupported type struct {}" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	expect := "*4\r\n-ERR unsupported type struct {}\r\n$1\r\nx\r\n*2\r\n-ERR unsupported type float64\r\n:2\r\n" +
+		"%2\r\n$1\r\na\r\n-ERR unsupported type float64\r\n$1\r\nb\r\n:1\r\n"
+	if buff.String() != expect {
+		t.Errorf("Unexpected Marshal %q", buff.String())
+	}
+	parser := newReplyParser(buff)
+	parser.SetProtocolVersion(3)
+	if cmd, err := parser.ReadCommand(); err != nil || len(cmd.Children()) != 4 || buff.Len() != 0 {
+		t.Errorf("Unexpected parsed reply %v %v", cmd, err)
+	}
+}
+
+func TestCommand_Unmarshal(t *testing.T) {
+	cmd, err := NewParser(strings.NewReader("*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n")).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var strs []string
+	if err = cmd.Unmarshal(&strs); err != nil || len(strs) != 4 || strs[2] != "b" {
+		t.Errorf("Unexpected []string %v %v", strs, err)
+	}
+	var m map[string]string
+	if err = cmd.Unmarshal(&m); err != nil || len(m) != 2 || m["a"] != "1" || m["b"] != "2" {
+		t.Errorf("Unexpected map %v %v", m, err)
+	}
+	var n int64
+	if err = cmd.Unmarshal(&n); err == nil {
+		t.Errorf("Expect type mismatch error")
+	}
+}
+
+func TestCommand_UnmarshalNested(t *testing.T) {
+	cmd, err := NewParser(strings.NewReader("*3\r\n:7\r\n+OK\r\n*2\r\n$1\r\nx\r\n$-1\r\n")).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var values []interface{}
+	if err = cmd.Unmarshal(&values); err != nil || len(values) != 3 {
+		t.Fatalf("Unexpected []interface{} %v %v", values, err)
+	}
+	if values[0] != int64(7) || values[1] != "OK" {
+		t.Errorf("Unexpected scalar values %v", values)
+	}
+	nested, ok := values[2].([]interface{})
+	if !ok || len(nested) != 2 || string(nested[0].([]byte)) != "x" || nested[1] != nil {
+		t.Errorf("Unexpected nested values %v", values[2])
+	}
+	var n int64
+	if err = cmd.Children()[0].Unmarshal(&n); err != nil || n != 7 {
+		t.Errorf("Unexpected int64 %d %v", n, err)
+	}
+	var strs []string
+	if err = cmd.Children()[2].Unmarshal(&strs); err != ErrNil {
+		t.Errorf("Expect ErrNil, got %v", err)
+	}
+}
@@ -1,57 +1,250 @@
 package redisproto
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"time"
+	"unicode/utf8"
 )
 
 var (
-	ExpectNumber   = &ProtocolError{"Expect Number"}
-	ExpectNewLine  = &ProtocolError{"Expect Newline"}
-	ExpectTypeChar = &ProtocolError{"Expect TypeChar"}
+	ExpectNumber   = &ProtocolError{message: "Expect Number"}
+	ExpectNewLine  = &ProtocolError{message: "Expect Newline"}
+	ExpectTypeChar = &ProtocolError{message: "Expect TypeChar"}
+	InvalidInline  = &ProtocolError{message: "Invalid Inline"}
 
 	InvalidNumArg   = errors.New("TooManyArg")
 	InvalidBulkSize = errors.New("Invalid bulk size")
 	LineTooLong     = errors.New("LineTooLong")
+	InvalidNesting  = errors.New("TooDeepNesting")
 
-	ReadBufferInitSize = 1 << 16
+	// ErrInvalidNumArg and ErrInvalidBulkSize are InvalidNumArg and InvalidBulkSize under the Err names, a
+	// LimitExceededError matches them with errors.Is.
+	ErrInvalidNumArg   = InvalidNumArg
+	ErrInvalidBulkSize = InvalidBulkSize
+	ErrCommandTooLarge = errors.New("redisproto: command exceeds MaxCommandBytes")
+	ErrReadTimeout     = errors.New("redisproto: read timeout")
+	ErrNoDeadline      = errors.New("redisproto: reader doesn't support read deadlines")
+	ErrQuotaExceeded   = errors.New("redisproto: MaxTotalBytes exceeded")
+	ErrInvalidUnread   = errors.New("redisproto: command already unread")
+	ErrNegativeSkip    = errors.New("redisproto: negative skip count")
+	ErrBufferLimit     = errors.New("redisproto: frame exceeds MaxBufferSize")
+	ErrEmptyCommand    = errors.New("redisproto: empty command")
+	// ErrIncompleteArray is the cause of the error returned when the stream ends before all the elements a
+	// multi-bulk command declared arrived, it wraps io.ErrUnexpectedEOF.
+	ErrIncompleteArray = fmt.Errorf("redisproto: incomplete array: %w", io.ErrUnexpectedEOF)
+	// ErrProtocolViolation is the cause of the error returned for a frame not allowed by the negotiated
+	// protocol, see ParserOptions.LockProtocol.
+	ErrProtocolViolation = errors.New("redisproto: protocol violation")
+	// ErrInvalidUTF8 is the cause of the error returned for text that isn't valid UTF-8, see
+	// ParserOptions.ValidateUTF8.
+	ErrInvalidUTF8 = errors.New("redisproto: invalid UTF-8")
+	// ErrStreamTransition is returned by ReadCommand when ParserOptions.OnFrame stops at a frame.
+	ErrStreamTransition = errors.New("redisproto: stream transition")
+
+	// the sizes and limits below are read when a parser is created, changing them doesn't affect existing parsers
+	ReadBufferInitSize = 1 << 16 // values below 512 count as 512
 	MaxNumArg          = 20
-	MaxBulkSize        = 1 << 16
+	MaxBulkSize        = int64(512 << 20) // same as redis proto-max-bulk-len
 	MaxTelnetLine      = 1 << 10
+	MaxLineSize        = 64 << 10 // longest single line frame, e.g. a status, error or the header of a custom type
+	MaxNestedLevel     = 8
+	growChunk          = 4 << 10 // growth granularity of a buffer close to MaxBufferSize
+	minBufferSize      = 512     // floor of ReadBufferInitSize, a smaller value would grow the buffer without slack
 	spaceSlice         = []byte{' '}
-	emptyBulk          = [0]byte{}
 )
 
+// LimitExceededError is returned when a command asks for more arguments than MaxNumArg (Kind "args") or a
+// larger bulk string than MaxBulkSize (Kind "bulk"), or when a read would take the stream past
+// ParserOptions.MaxTotalBytes (Kind "bytes"), it tells the requested value and the limit in force.
+// errors.Is(err, InvalidNumArg), errors.Is(err, InvalidBulkSize) or errors.Is(err, ErrQuotaExceeded) matches it
+// depending on Kind.
+type LimitExceededError struct {
+	Kind      string
+	Requested int64
+	Limit     int64
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s: requested %d %s, limit %d", e.Unwrap(), e.Requested, e.Kind, e.Limit)
+}
+
+// Unwrap returns the sentinel of the limit, InvalidNumArg, InvalidBulkSize or ErrQuotaExceeded.
+func (e *LimitExceededError) Unwrap() error {
+	switch e.Kind {
+	case "args":
+		return InvalidNumArg
+	case "bytes":
+		return ErrQuotaExceeded
+	}
+	return InvalidBulkSize
+}
+
+func (r *Parser) tooManyArgs(requested int64) error {
+	return &LimitExceededError{Kind: "args", Requested: requested, Limit: int64(r.maxNumArg())}
+}
+
+func (r *Parser) bulkTooLarge(requested int64) error {
+	return &LimitExceededError{Kind: "bulk", Requested: requested, Limit: r.maxBulkSize()}
+}
+
+// ProtocolError is returned for malformed input, after it the parser is out of sync with the stream (see
+// ReadCommand).
 type ProtocolError struct {
 	message string
+	cause   error
 }
 
 func (p *ProtocolError) Error() string {
 	return p.message
 }
 
-type Command struct {
-	argv [][]byte
-	last bool
+// Unwrap returns the underlying error of a protocol error given context, e.g. the element of an array it
+// happened in, so errors.Is(err, ExpectTypeChar) keeps working.
+func (p *ProtocolError) Unwrap() error {
+	return p.cause
 }
 
-func (c *Command) Get(index int) []byte {
-	if index >= 0 && index < len(c.argv) {
-		return c.argv[index]
-	} else {
-		return nil
+// incompleteArray turns the end of stream inside a top level array into an error telling how many of the
+// declared elements arrived, e.g. to tell a client that stopped short from a cut connection.
+func incompleteArray(depth, numArg, got int, err error) error {
+	if depth != 0 || err != io.EOF {
+		return err
+	}
+	msg := fmt.Sprintf("redisproto: incomplete array, declared %d elements but got %d", numArg, got)
+	if numArg < 0 {
+		msg = fmt.Sprintf("redisproto: incomplete streamed array, got %d elements", got)
 	}
+	return &ProtocolError{message: msg, cause: ErrIncompleteArray}
+}
+
+func (r *Parser) rejectEmpty() bool {
+	return r.opts.RejectEmptyCommands || r.opts.Mode == ModeServer
 }
 
-func (c *Command) ArgCount() int {
-	return len(c.argv)
+func emptyCommand(numArg int64) error {
+	return &ProtocolError{message: fmt.Sprintf("redisproto: empty command \"*%d\"", numArg), cause: ErrEmptyCommand}
+}
+
+// elementError adds the index of the array element being parsed to a protocol error.
+func elementError(index int, err error) error {
+	if p, ok := err.(*ProtocolError); ok {
+		return &ProtocolError{message: fmt.Sprintf("array element %d: %s", index, p.message), cause: p}
+	}
+	return err
 }
 
-// IsLast is true if this command is the last one in receive buffer, command handler should call writer.Flush()
-// after write response, helpful in process pipeline command.
-func (c *Command) IsLast() bool {
-	return c.last
+// Mode selects which frames a parser accepts at the top level.
+type Mode int
+
+const (
+	// ModeAny, the default, accepts multi-bulk and inline commands like parsers always did, a line starting with
+	// a reply type char ('$', ':', '+', '-') is an inline command too. Reply frames are only read in ModeClient.
+	ModeAny Mode = iota
+	// ModeServer parses commands sent by clients, it accepts multi-bulk and inline commands and rejects reply
+	// frames ('$', ':', '+', '-') with ExpectTypeChar, so a client can't confuse the server with replies.
+	// Empty and null arrays fail with ErrEmptyCommand.
+	ModeServer
+	// ModeClient parses replies sent by servers, it accepts RESP frames and rejects inline commands.
+	ModeClient
+)
+
+// ParserOptions customizes a parser created by NewParserWithOptions, the zero value gives the same parser
+// as NewParser.
+type ParserOptions struct {
+	// PoolCommands draws multi-bulk commands and their argv slices from a shared sync.Pool, pass commands
+	// back with Command.Release once handled to cut allocations.
+	PoolCommands bool
+	// ShrinkAfter shrinks a read buffer grown by a large command back to its initial size once that many
+	// consecutive commands each fit in a quarter of it, bounding steady-state memory. Zero never shrinks.
+	ShrinkAfter int
+	// ReuseArgv makes multi-bulk commands share one argv slice kept by the parser, so the argument list is
+	// valid only until the next ReadCommand like the arguments themselves. Ignored when PoolCommands is set.
+	ReuseArgv bool
+	// Mode tells whether the parser reads commands, replies or both (the default).
+	Mode Mode
+	// MaxCommandBytes bounds the total wire size of a single command, a command growing past it fails with
+	// ErrCommandTooLarge before its oversized bulk is buffered. Zero means unlimited.
+	MaxCommandBytes int
+	// LenientNewline accepts a bare \r as the terminator of inline commands, as sent by some legacy tools,
+	// besides \n and \r\n.
+	LenientNewline bool
+	// ReadChunk keeps at least that many bytes of free buffer space before each read from the reader, so one
+	// read syscall can pull in a whole pipeline rather than only the bytes the parser is waiting for. Reads
+	// still return as soon as the needed bytes arrive. Zero keeps reads bounded by the current free space,
+	// 4KB is a good value for busy connections.
+	ReadChunk int
+	// StrictInline rejects inline commands containing NUL or other control bytes with InvalidInline, guarding
+	// against binary junk being run as a command. Tabs are allowed, they separate arguments.
+	StrictInline bool
+	// MaxBulkSize overrides the package MaxBulkSize for this parser when greater than zero. Either is capped to
+	// what an int can index, 2GB on 32-bit platforms.
+	MaxBulkSize int64
+	// ReadTimeout sets a read deadline before every read when the reader supports SetReadDeadline (e.g. a
+	// net.Conn), a client stalling longer makes ReadCommand fail with an error wrapping ErrReadTimeout.
+	ReadTimeout time.Duration
+	// DisableInline makes a leading byte other than a RESP type char fail with ExpectTypeChar instead of being
+	// parsed as an inline command, so a desynced RESP stream is caught rather than run as telnet input.
+	DisableInline bool
+	// Allocator, when set, provides the memory of Command.Copy for commands read by this parser, see Allocator.
+	Allocator Allocator
+	// MaxBufferSize caps the capacity of the read buffer when greater than zero, near the cap the bytes of
+	// commands already returned are dropped and the buffer grows only by what's needed. A frame that can't fit
+	// fails with ErrBufferLimit. It bounds the memory of many connections parsing large values at once.
+	MaxBufferSize int
+	// ReleaseLargeBuffers replaces a read buffer grown past its initial size with a fresh one as soon as it's
+	// drained, so the large backing array left by a big command becomes collectable once that command is
+	// dropped, see ResetAndRelease. Unlike ShrinkAfter it doesn't wait for small commands to follow.
+	ReleaseLargeBuffers bool
+	// KeepBlankInline returns a blank or whitespace only inline line as a command with no arguments (ArgCount() is 0)
+	// instead of skipping it like redis does.
+	KeepBlankInline bool
+	// RejectEmptyCommands fails the empty ("*0") and null ("*-1") arrays at the top level with ErrEmptyCommand,
+	// a client always sends at least the command name. It's implied by ModeServer.
+	RejectEmptyCommands bool
+	// MaxTotalBytes caps the bytes a parser reads from its reader over its whole life, once a command needs more
+	// the read fails with a LimitExceededError matching ErrQuotaExceeded, e.g. to bound what a single connection can send. Zero is unlimited.
+	MaxTotalBytes int64
+	// PreserveEmptyFields splits inline commands on every single space, so "SET  k" gives an empty argument
+	// between SET and k. By default runs of spaces and tabs separate arguments like redis does.
+	PreserveEmptyFields bool
+	// SkipComments skips lines starting with '#' between commands, for replaying annotated RESP fixtures. It only
+	// applies in RESP2, where '#' isn't the boolean type char, and never inside a frame. Leave it off for live
+	// connections.
+	SkipComments bool
+	// LockProtocol makes ReadCommand fail with ErrProtocolViolation, once SetProtocolVersion has been called, on
+	// any frame the negotiated version and Mode don't allow at the top level: inline commands, blank lines
+	// included, and the RESP3 only types on RESP2. It hardens a server against clients switching protocols after
+	// HELLO to confuse it. Types added with RegisterType stay allowed.
+	LockProtocol bool
+	// CopyOnRead makes ReadCommand return commands deep copied out of the read buffer, through Allocator when
+	// set, so their arguments stay valid after the next ReadCommand and can be retained without Copy. It costs
+	// an allocation and a copy of the data per command; off, commands alias the buffer and nothing is copied.
+	// A pooled command is released once copied, the copy itself isn't pooled.
+	CopyOnRead bool
+	// ValidateUTF8 fails inline commands and simple string or error replies ('+', '-') that aren't valid UTF-8
+	// with an error wrapping ErrInvalidUTF8, for text only protocols layered on RESP, e.g. JSON payloads. Bulk
+	// strings stay binary safe whatever the option.
+	ValidateUTF8 bool
+	// OnFrame, when set, is called at the start of every top level frame, blank inline lines included, with its
+	// first byte and the rest of its first line without the line ending, e.g. '*' and "-1" for a null array.
+	// Returning true makes ReadCommand fail with ErrStreamTransition leaving the frame unread, e.g. for
+	// replication tooling to detect the switch from the initial payload to the command stream and read what
+	// follows with NextBulkReader or Skip. header points into the read buffer and is only valid during the call.
+	OnFrame func(typeChar byte, header []byte) (stop bool)
+	// QuotedInline splits inline commands like redis-cli and redis do, honouring double and single quotes so an
+	// argument can hold spaces: in double quotes \" \\ \n \r \t \b \a and \xHH are escapes, in single quotes
+	// only \'. A closing quote must end the argument, unbalanced quotes fail with an error wrapping
+	// InvalidInline. Writer.WriteInline produces such lines. Without it quotes are plain bytes.
+	QuotedInline bool
+	// OnCommand is called with every command successfully returned by ReadCommand and OnError with every error
+	// other than a clean io.EOF, e.g. for metrics. Both run synchronously on the parse path, offload heavy work.
+	OnCommand func(*Command)
+	OnError   func(error)
 }
 
 type Parser struct {
@@ -59,6 +252,38 @@ type Parser struct {
 	buffer        []byte
 	parsePosition int
 	writeIndex    int
+	opts          ParserOptions
+	initSize      int
+	argv          [][]byte      // reused by ReuseArgv
+	cmdBegin      int           // buffer index where the command being parsed starts
+	skipLF        bool          // an inline command ended with \r, skip a \n starting the next read
+	base          int64         // stream offset of buffer[0]
+	smallRun      int           // consecutive commands small enough to fit a shrunk buffer
+	partial       *Command      // arguments of a command cut short by the end of the stream, see LastPartial
+	resp3         bool          // accept the RESP3 only types, see SetProtocolVersion
+	bufr          *bufio.Reader // reader if it's a *bufio.Reader, see readSome
+	maxArgs       int           // overrides MaxNumArg for one ReadCommandLimited call
+	numArgs       int           // MaxNumArg, snapshot of the global
+	bulkSize      int64         // MaxBulkSize or ParserOptions.MaxBulkSize
+	telnetLine    int           // MaxTelnetLine
+	lineSize      int           // MaxLineSize
+	nesting       int           // MaxNestedLevel
+	growSize      int           // ReadBufferInitSize, see bufferInitSize
+	pending       int           // arguments left after ReadHeader, see Drain
+	bulk          *bulkReader   // last reader returned by NextBulkReader
+	maxBytes      int           // overrides MaxCommandBytes for one ReadCommandLimited call
+	dataToken     bool          // NextToken returns tokenLen bytes of bulk data next
+	tokenLen      int           // length of that data
+	commands      int64         // commands returned by ReadCommand, see Stats
+	protoErrors   int64         // protocol errors returned by ReadCommand
+	deadline      time.Time     // deadline of the command read by ReadCommandTimeout
+	unread        *Command      // returned by the next ReadCommand, see Unread
+	versionSet    bool          // SetProtocolVersion was called, see ParserOptions.LockProtocol
+	errAtLine     bool          // the last frame failed right after a \n, see Resync
+	oneRead       bool          // a ReadCommandNonBlocking call is limited to one read, see readSome
+	reads         int           // reads made by that call
+
+	types map[byte]func(*Parser) (*Command, error) // see RegisterType
 }
 
 func max(a, b int) int {
@@ -67,27 +292,287 @@ func max(a, b int) int {
 	}
 	return b
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
 func NewParser(reader io.Reader) *Parser {
-	return &Parser{reader: reader, buffer: make([]byte, ReadBufferInitSize)}
+	return NewParserWithOptions(reader, ParserOptions{})
+}
+
+func NewParserWithOptions(reader io.Reader, opts ParserOptions) *Parser {
+	size := bufferInitSize()
+	if opts.MaxBufferSize > 0 {
+		size = min(size, opts.MaxBufferSize)
+	}
+	return newParser(reader, size, opts)
+}
+
+// NewParserSize creates a parser whose read buffer starts at initialSize bytes instead of ReadBufferInitSize,
+// the buffer still grows on demand. A small size saves memory for many mostly idle connections, a size of zero
+// or less counts as 512.
+func NewParserSize(reader io.Reader, initialSize int) *Parser {
+	if initialSize <= 0 {
+		initialSize = minBufferSize
+	}
+	return newParser(reader, initialSize, ParserOptions{})
+}
+
+// NewParserWithPrefix creates a parser that reads prefix before anything from reader, for bytes already taken
+// off the connection, e.g. the first byte sniffed by a protocol detecting listener. prefix is copied and counts
+// as stream data for Position.
+func NewParserWithPrefix(reader io.Reader, prefix []byte) *Parser {
+	r := newParser(reader, max(bufferInitSize(), len(prefix)), ParserOptions{})
+	r.writeIndex = copy(r.buffer, prefix)
+	return r
+}
+
+func newParser(reader io.Reader, initialSize int, opts ParserOptions) *Parser {
+	bufr, _ := reader.(*bufio.Reader)
+	bulkSize := MaxBulkSize
+	if opts.MaxBulkSize > 0 {
+		bulkSize = opts.MaxBulkSize
+	}
+	if bulkSize > math.MaxInt-2 {
+		// a bulk and its CRLF are indexed with ints, on 32-bit platforms a larger length would be truncated
+		bulkSize = math.MaxInt - 2
+	}
+	return &Parser{reader: reader, buffer: make([]byte, initialSize), initSize: initialSize, opts: opts, bufr: bufr,
+		numArgs: MaxNumArg, bulkSize: bulkSize, telnetLine: MaxTelnetLine, lineSize: MaxLineSize,
+		nesting: MaxNestedLevel, growSize: bufferInitSize()}
+}
+
+// bufferInitSize returns ReadBufferInitSize, at least minBufferSize so a zero or tiny value doesn't grow the
+// buffer by a few bytes per read.
+func bufferInitSize() int {
+	return max(ReadBufferInitSize, minBufferSize)
+}
+
+// Buffered returns the number of received bytes not yet parsed, when it's greater than zero the next
+// ReadCommand can make progress without waiting on the reader first.
+func (r *Parser) Buffered() int {
+	return r.writeIndex - r.parsePosition
+}
+
+// Position returns the number of bytes consumed from the stream since the parser was created, e.g. the file
+// offset of the next command when reading an AOF.
+func (r *Parser) Position() int64 {
+	return r.base + int64(r.parsePosition)
+}
+
+// ParserStats is a snapshot of the counters of a parser, see Parser.Stats.
+type ParserStats struct {
+	Commands       int64 // commands read
+	Bytes          int64 // bytes consumed from the stream, same as Position
+	ProtocolErrors int64 // ReadCommand errors caused by malformed input rather than the reader
+}
+
+// Stats returns the number of commands, bytes and protocol errors the parser has seen, for per connection
+// metrics. The counters are plain fields updated by ReadCommand, so like the parser itself Stats must be called
+// from the goroutine reading the commands.
+func (r *Parser) Stats() ParserStats {
+	return ParserStats{Commands: r.commands, Bytes: r.Position(), ProtocolErrors: r.protoErrors}
+}
+
+// isProtocolError tells malformed input apart from the reader failing or the stream ending.
+func isProtocolError(err error) bool {
+	switch err {
+	case InvalidNumArg, InvalidBulkSize, LineTooLong, InvalidNesting, ErrCommandTooLarge, ErrBufferLimit:
+		return true
+	}
+	if l, ok := err.(*LimitExceededError); ok {
+		return l.Kind != "bytes" // the quota is no malformed input
+	}
+	var p *ProtocolError
+	return errors.As(err, &p) && !errors.Is(err, io.ErrUnexpectedEOF)
 }
 
-// ensure that we have enough space for writing 'req' byte
-func (r *Parser) requestSpace(req int) {
+// Skip advances past the next n bytes of the stream without parsing them, taking buffered bytes first. The
+// bytes are read through the buffer a chunk at a time, so skipping a large payload doesn't grow it. n is an
+// int64 like the bulk sizes, so payloads past the int range of 32-bit platforms can be skipped too. A negative
+// n fails with ErrNegativeSkip, the parser can't go back.
+func (r *Parser) Skip(n int64) error {
+	if n < 0 {
+		return ErrNegativeSkip
+	}
+	for n > 0 {
+		if r.parsePosition >= r.writeIndex {
+			r.reset()
+			if e := r.readSome(1); e != nil {
+				if e == io.EOF {
+					e = io.ErrUnexpectedEOF
+				}
+				return e
+			}
+		}
+		step := r.writeIndex - r.parsePosition
+		if n < int64(step) {
+			step = int(n)
+		}
+		r.parsePosition += step
+		n -= int64(step)
+	}
+	if r.parsePosition >= r.writeIndex {
+		r.reset()
+	}
+	return nil
+}
+
+// ReadLine reads the next CRLF terminated line and returns it without the CRLF, for handlers added with
+// RegisterType. Like Command.Get the line points into the read buffer and is only valid until the next
+// ReadCommand. A line longer than MaxLineSize fails with LineTooLong.
+func (r *Parser) ReadLine() ([]byte, error) {
+	return r.readLine()
+}
+
+// ReadInt reads a base 10 integer with an optional sign followed by a CRLF, e.g. the length of a custom
+// frame, for handlers added with RegisterType. It fails with ExpectNumber or ExpectNewLine on anything else.
+func (r *Parser) ReadInt() (int64, error) {
+	n, err := r.readNumber()
+	if err != nil {
+		return 0, err
+	}
+	return n, r.discardNewLine()
+}
+
+// ReadNewLine consumes a CRLF, e.g. the one ending the payload of a custom frame, and fails with ExpectNewLine
+// when the next bytes are anything else.
+func (r *Parser) ReadNewLine() error {
+	return r.discardNewLine()
+}
+
+// ensure that we have enough space for writing 'req' byte, under MaxBufferSize only 'need' of them are
+// guaranteed
+func (r *Parser) requestSpace(need, req int) error {
 	ccap := cap(r.buffer)
-	if r.writeIndex+req > ccap {
-		newbuff := make([]byte, max(ccap*2, ccap+req+ReadBufferInitSize))
-		copy(newbuff, r.buffer)
-		r.buffer = newbuff
+	if r.writeIndex+req <= ccap {
+		return nil
+	}
+	// at least writeIndex+req as writeIndex <= ccap, and growSize gives slack even to an empty buffer
+	size := max(ccap*2, ccap+req+r.growSize)
+	keep := 0
+	if limit := r.opts.MaxBufferSize; limit > 0 && size > limit {
+		// drop the commands already returned, they point into the old buffer which is left untouched
+		keep = min(r.cmdBegin, r.parsePosition)
+		used := r.writeIndex - keep
+		if used+need > limit {
+			return ErrBufferLimit
+		}
+		size = min(limit, (used+req+growChunk-1)/growChunk*growChunk)
+		if keep == 0 && size <= ccap {
+			return nil // can't grow any further, need already fits
+		}
 	}
+	newbuff := make([]byte, size)
+	copy(newbuff, r.buffer[keep:r.writeIndex])
+	r.buffer = newbuff
+	r.parsePosition -= keep
+	r.writeIndex -= keep
+	r.cmdBegin -= keep
+	r.base += int64(keep)
+	return nil
+}
+
+type deadlineReader interface {
+	SetReadDeadline(time.Time) error
 }
+
 func (r *Parser) readSome(min int) error {
-	r.requestSpace(min)
-	nr, err := io.ReadAtLeast(r.reader, r.buffer[r.writeIndex:], min)
+	if r.oneRead && r.reads > 0 {
+		return errNeedMore
+	}
+	// make room for a whole chunk so a single read can pull in a pipeline, but only wait for min
+	chunk := r.opts.ReadChunk
+	if r.bufr != nil && r.bufr.Buffered() == 0 {
+		// a bufio.Reader with an empty buffer reads straight into a slice at least as large as its buffer,
+		// skipping the copy through it
+		chunk = max(chunk, r.bufr.Size())
+	}
+	if err := r.requestSpace(min, max(min, chunk)); err != nil {
+		return err
+	}
+	if err := r.setDeadline(); err != nil {
+		return err
+	}
+	buf, err := r.clampToQuota(r.buffer[r.writeIndex:], min)
 	if err != nil {
 		return err
 	}
+	var nr int
+	if r.oneRead {
+		r.reads++
+		nr, err = r.reader.Read(buf)
+		if nr >= min {
+			err = nil // like io.ReadAtLeast, an error coming with the data shows up on the next read
+		} else if err == nil || err == io.EOF && nr > 0 {
+			err = errNeedMore
+		}
+	} else {
+		nr, err = io.ReadAtLeast(r.reader, buf, min)
+	}
 	r.writeIndex += nr
-	return nil
+	return readError(err)
+}
+
+// readDirect reads into p straight from the reader, bypassing the buffer, for streaming bulk data. Like
+// readSome it applies the read deadline and MaxTotalBytes, the caller accounts the bytes read in base.
+func (r *Parser) readDirect(p []byte) (int, error) {
+	if err := r.setDeadline(); err != nil {
+		return 0, err
+	}
+	p, err := r.clampToQuota(p, 1)
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	return n, readError(err)
+}
+
+// setDeadline sets the read deadline of ParserOptions.ReadTimeout and ReadCommandTimeout before a read.
+func (r *Parser) setDeadline() error {
+	if r.opts.ReadTimeout == 0 && r.deadline.IsZero() {
+		return nil
+	}
+	d, ok := r.reader.(deadlineReader)
+	if !ok {
+		return nil
+	}
+	deadline := r.deadline
+	if r.opts.ReadTimeout > 0 {
+		if t := time.Now().Add(r.opts.ReadTimeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return d.SetReadDeadline(deadline)
+}
+
+// clampToQuota shortens buf to what MaxTotalBytes still allows reading, failing when that's less than min.
+func (r *Parser) clampToQuota(buf []byte, min int) ([]byte, error) {
+	if r.opts.MaxTotalBytes <= 0 {
+		return buf, nil
+	}
+	// base+writeIndex is every byte read so far, whatever compaction and resets did to the buffer
+	read := r.base + int64(r.writeIndex)
+	left := r.opts.MaxTotalBytes - read
+	if left < int64(min) {
+		return nil, &LimitExceededError{Kind: "bytes", Requested: read + int64(min), Limit: r.opts.MaxTotalBytes}
+	}
+	if int64(len(buf)) > left {
+		buf = buf[:left]
+	}
+	return buf, nil
+}
+
+// readError marks a timeout of the reader with ErrReadTimeout, the reader's error stays in the chain for
+// errors.Is(err, os.ErrDeadlineExceeded) and errors.As with net.Error.
+func readError(err error) error {
+	if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+		return fmt.Errorf("%w: %w", ErrReadTimeout, err)
+	}
+	return err
 }
 
 // check for at least 'num' byte available in buffer to use, wait if need
@@ -96,12 +581,19 @@ func (r *Parser) requireNBytes(num int) error {
 	if a >= num {
 		return nil
 	}
-	if err := r.readSome(num - a); err != nil {
-		return err
+	// grow along with the data actually received, a large declared length alone doesn't allocate it all
+	for a < num {
+		if err := r.readSome(min(num-a, max(cap(r.buffer), r.growSize))); err != nil {
+			return err
+		}
+		a = r.writeIndex - r.parsePosition
 	}
 	return nil
 }
-func (r *Parser) readNumber() (int, error) {
+
+// readNumber reads a decimal number, it's int64 on every platform so lengths can be range checked before
+// converting to int.
+func (r *Parser) readNumber() (int64, error) {
 	var neg = false
 	err := r.requireNBytes(1)
 	if err != nil {
@@ -118,14 +610,19 @@ func (r *Parser) readNumber() (int, error) {
 		break
 	}
 	var num uint64 = 0
-	var startpos int = r.parsePosition
+	// count the digits rather than compare positions so a sign alone ("+\r\n", "-\r\n") is never a number
+	var digits int
 OUTTER:
 	for {
 		for i := r.parsePosition; i < r.writeIndex; i++ {
 			c := r.buffer[r.parsePosition]
 			if c >= '0' && c <= '9' {
+				if num > (math.MaxInt64-uint64(c-'0'))/10 {
+					return 0, ExpectNumber // overflow
+				}
 				num = num*10 + uint64(c-'0')
 				r.parsePosition++
+				digits++
 			} else {
 				break OUTTER
 			}
@@ -136,13 +633,13 @@ OUTTER:
 			}
 		}
 	}
-	if r.parsePosition == startpos {
+	if digits == 0 {
 		return 0, ExpectNumber
 	}
 	if neg {
-		return -int(num), nil
+		return -int64(num), nil
 	} else {
-		return int(num), nil
+		return int64(num), nil
 	}
 
 }
@@ -158,100 +655,1013 @@ func (r *Parser) discardNewLine() error {
 }
 
 func (r *Parser) parseBinary() (*Command, error) {
+	return r.parseAggregate(0)
+}
+
+// parseAggregate reads an array or one of the RESP3 map, set, push and attribute frames, maps and attributes
+// keep their keys and values alternating in the elements.
+func (r *Parser) parseAggregate(depth int) (*Command, error) {
+	typ := CommandType(r.buffer[r.parsePosition])
 	r.parsePosition++
-	numArg, err := r.readNumber()
+	numArg, streamed, err := r.readLength()
 	if err != nil {
 		return nil, err
 	}
-	var e error
-	if e = r.discardNewLine(); e != nil {
-		return nil, e
+	if depth == 0 && typ == Multi && !streamed && numArg <= 0 && numArg >= -1 && r.rejectEmpty() {
+		return nil, emptyCommand(numArg)
 	}
 	switch {
+	case streamed:
+		numArg = -1
 	case numArg == -1:
-		return nil, r.discardNewLine() // null array
+		return &Command{typ: typ, null: true}, nil // null array
 	case numArg < -1:
 		return nil, InvalidNumArg
-	case numArg > MaxNumArg:
-		return nil, InvalidNumArg
+	case typ == Map || typ == Attribute:
+		numArg *= 2
+	}
+	if numArg > int64(r.maxNumArg()) {
+		return nil, r.tooManyArgs(numArg)
+	}
+	cmd, err := r.parseElements(int(numArg), depth)
+	if cmd != nil {
+		cmd.typ = typ
+	}
+	return cmd, err
+}
+
+// parseElements reads numArg elements of an array, bulk strings are kept flat in argv while any other
+// element type makes the array keep all its elements in children as well.
+// A negative numArg reads a RESP3 streamed aggregate, elements until the '.' terminator.
+func (r *Parser) parseElements(numArg int, depth int) (*Command, error) {
+	declared := numArg
+	streamed := numArg < 0
+	if streamed {
+		numArg = 0
+	}
+	cmd := r.newArray(numArg, depth)
+	argv := cmd.argv
+	var children []*Command
+	for i := 0; streamed || i < numArg; i++ {
+		if streamed {
+			if e := r.requireNBytes(1); e != nil {
+				r.keepPartial(cmd, depth, argv, e)
+				cmd.Release()
+				return nil, incompleteArray(depth, declared, i, e)
+			}
+			if r.buffer[r.parsePosition] == '.' {
+				r.parsePosition++
+				if e := r.discardNewLine(); e != nil {
+					cmd.Release()
+					return nil, e
+				}
+				break
+			}
+			if i >= r.maxNumArg() {
+				cmd.Release()
+				return nil, r.tooManyArgs(int64(i + 1))
+			}
+		}
+		if depth == 0 && r.opts.Mode == ModeServer {
+			// commands sent by clients are arrays of bulk strings only
+			if e := r.requireNBytes(1); e != nil {
+				r.keepPartial(cmd, depth, argv, e)
+				cmd.Release()
+				return nil, incompleteArray(depth, declared, i, e)
+			}
+			if c := r.buffer[r.parsePosition]; c != '$' {
+				cmd.Release()
+				return nil, elementError(i, &ProtocolError{message: fmt.Sprintf("expect '$', got %q", c), cause: ExpectTypeChar})
+			}
+		}
+		arg, child, e := r.parseElement(depth)
+		if e != nil {
+			r.keepPartial(cmd, depth, argv, e)
+			cmd.Release()
+			return nil, incompleteArray(depth, declared, i, elementError(i, e))
+		}
+		if child != nil && children == nil {
+			children = make([]*Command, 0, numArg)
+			for j := 0; j < i; j++ {
+				children = append(children, newBulk(argv[j]))
+			}
+		}
+		if children != nil {
+			if child == nil {
+				child = newBulk(arg)
+			}
+			children = append(children, child)
+		}
+		if arg == nil && (child == nil || child.typ == Bulk || child.null) {
+			cmd.setNull(i)
+		}
+		argv = append(argv, arg)
+	}
+	cmd.argv = argv
+	cmd.children = children
+	cmd.streamed = streamed
+	return cmd, nil
+}
+
+// SetProtocolVersion selects the RESP version of the connection, e.g. after a HELLO exchange. Version 3 accepts
+// the RESP3 only types (double, boolean, null, big number, verbatim string, blob error, map, set, push and
+// attribute), any other value gives RESP2 where they fail with ExpectTypeChar, inside aggregates as well as at
+// the top level, unless RegisterType took the byte. Like the other replies they're only read at the top level
+// in ModeClient. The default is RESP2.
+func (r *Parser) SetProtocolVersion(v int) {
+	r.resp3 = v == 3
+	r.versionSet = true
+}
+
+// negotiated tells whether a frame starting with c is allowed once the protocol is locked.
+func (r *Parser) negotiated(c byte) bool {
+	if r.types[c] != nil {
+		return true
+	}
+	switch c {
+	case '*':
+		return true
+	case '$', ':', '+', '-':
+		return r.opts.Mode == ModeClient
+	}
+	return resp3Type(c) && r.resp3 && r.opts.Mode == ModeClient
+}
+
+// resp3Type tells whether c is the type char of one of the RESP3 only frames.
+func resp3Type(c byte) bool {
+	switch c {
+	case ',', '#', '_', '(', '=', '!', '%', '~', '>', '|':
+		return true
+	}
+	return false
+}
+
+// resp3Aggregate tells whether c is the type char of a RESP3 aggregate: map, set, push or attribute.
+func resp3Aggregate(c byte) bool {
+	switch c {
+	case '%', '~', '>', '|':
+		return true
+	}
+	return false
+}
+
+// newArray allocates an array command for numArg elements, top level ones as configured by PoolCommands and
+// ReuseArgv.
+func (r *Parser) newArray(numArg int, depth int) *Command {
+	if depth == 0 && r.opts.PoolCommands {
+		return getCommand(numArg)
+	} else if depth == 0 && r.opts.ReuseArgv {
+		if cap(r.argv) < numArg {
+			r.argv = make([][]byte, 0, numArg)
+		}
+		return &Command{argv: r.argv[:0], typ: Multi}
+	}
+	return &Command{argv: make([][]byte, 0, numArg), typ: Multi}
+}
+
+// parseFast parses a multi-bulk command of bulk strings lying entirely in the buffer in a single pass, the
+// common case of a client command. It returns nil without consuming anything for any other command, including
+// malformed ones, so parseBinary handles it and reports the same errors.
+func (r *Parser) parseFast() *Command {
+	buf := r.buffer[r.parsePosition:r.writeIndex]
+	numArg, i := scanLength(buf, 1)
+	if numArg <= 0 || numArg > r.maxNumArg() {
+		return nil
+	}
+	// check the whole frame first so falling back costs no allocation
+	begin := i
+	for k := 0; k < numArg; k++ {
+		if i >= len(buf) || buf[i] != '$' {
+			return nil
+		}
+		n, j := scanLength(buf, i+1)
+		if n < 0 || int64(n) > r.bulkSize || j+n+2 > len(buf) || buf[j+n] != '\r' || buf[j+n+1] != '\n' {
+			return nil
+		}
+		i = j + n + 2
+	}
+	cmd := r.newArray(numArg, 0)
+	for i = begin; len(cmd.argv) < numArg; {
+		n, j := scanLength(buf, i+1)
+		cmd.argv = append(cmd.argv, buf[j:j+n:j+n])
+		i = j + n + 2
+	}
+	r.parsePosition += i
+	return cmd
+}
+
+// scanLength parses the digits of a length starting at buf[i] up to its CRLF, it returns the length and the
+// index following the CRLF or -1 if there's no plain, reasonably sized length at i.
+func scanLength(buf []byte, i int) (int, int) {
+	n, start := 0, i
+	for ; i < len(buf) && buf[i] >= '0' && buf[i] <= '9'; i++ {
+		if i-start >= 9 {
+			return -1, 0
+		}
+		n = n*10 + int(buf[i]-'0')
+	}
+	if i == start || i+1 >= len(buf) || buf[i] != '\r' || buf[i+1] != '\n' {
+		return -1, 0
+	}
+	return n, i + 2
+}
+
+// RegisterType makes fn parse the frames starting with b, for protocol extensions with custom type chars. fn is
+// called with the parser positioned at the type char and must consume the whole frame, returning a command or
+// an error; returning neither skips the frame. Registered bytes take precedence over the inline command
+// fallback but never over the built-in types (RESP3 ones included once enabled). A nil fn removes the handler.
+func (r *Parser) RegisterType(b byte, fn func(*Parser) (*Command, error)) {
+	if fn == nil {
+		delete(r.types, b)
+		return
+	}
+	if r.types == nil {
+		r.types = make(map[byte]func(*Parser) (*Command, error))
+	}
+	r.types[b] = fn
+}
+
+func (r *Parser) parseCustom(fn func(*Parser) (*Command, error)) (*Command, error) {
+	start := r.Position()
+	cmd, err := fn(r)
+	n := int(r.Position() - start)
+	if err == nil && n == 0 {
+		return nil, ExpectTypeChar // the handler didn't consume the frame, looping on it would never end
+	}
+	if cmd != nil {
+		cmd.alloc = r.opts.Allocator
+		cmd.bytes = n
+		if r.parsePosition-r.cmdBegin == n {
+			cmd.raw = r.buffer[r.cmdBegin:r.parsePosition]
+		} // else the frame wasn't read through the buffer, there's no raw
+	}
+	return cmd, err
+}
+
+// keepPartial copies the complete top level arguments of a command the stream ended in the middle of.
+func (r *Parser) keepPartial(cmd *Command, depth int, argv [][]byte, err error) {
+	if depth == 0 && err == io.EOF {
+		r.partial = (&Command{argv: argv, typ: Multi, nulls: cmd.nulls}).Copy()
+	}
+}
+
+// LastPartial returns the arguments read before the stream ended in the middle of a command, i.e. when
+// ReadCommand failed with io.ErrUnexpectedEOF or ErrIncompleteArray, for reporting incomplete commands. It's nil if the last
+// ReadCommand didn't stop inside a multi-bulk command. The command is a copy and safe to retain.
+func (r *Parser) LastPartial() *Command {
+	return r.partial
+}
+
+// parseElement reads one element of an array dispatching on its type char. A bulk string is returned as
+// plain data with a nil command, other types return their payload (nil for arrays) and a command.
+func (r *Parser) parseElement(depth int) ([]byte, *Command, error) {
+	if e := r.requireNBytes(1); e != nil {
+		return nil, nil, e
+	}
+	switch r.buffer[r.parsePosition] {
+	case '$':
+		arg, e := r.parseString()
+		return arg, nil, e
+	case ':':
+		r.parsePosition++
+		begin := r.parsePosition - r.cmdBegin // relative, MaxBufferSize may compact the buffer while reading
+		num, e := r.readNumber()
+		if e != nil {
+			return nil, nil, e
+		}
+		arg := r.buffer[r.cmdBegin+begin : r.parsePosition]
+		if e = r.discardNewLine(); e != nil {
+			return nil, nil, e
+		}
+		cmd := newScalar(Number, arg)
+		cmd.num = num
+		return arg, cmd, nil
+	case '+', '-':
+		typ := CommandType(r.buffer[r.parsePosition])
+		r.parsePosition++
+		arg, e := r.readLine()
+		if e != nil {
+			return nil, nil, e
+		}
+		if r.opts.ValidateUTF8 && !utf8.Valid(arg) {
+			return nil, nil, &ProtocolError{message: "invalid UTF-8 in simple string", cause: ErrInvalidUTF8}
+		}
+		return arg, newScalar(typ, arg), nil
+	case '*':
+		if depth >= r.nesting {
+			return nil, nil, InvalidNesting
+		}
+		child, e := r.parseAggregate(depth + 1)
+		return nil, child, e
+	}
+	if r.resp3 && resp3Type(r.buffer[r.parsePosition]) {
+		return r.parseRESP3Element(depth)
+	}
+	return nil, nil, ExpectTypeChar
+}
+
+// parseRESP3Element reads an element of one of the RESP3 only types. An attribute inside an aggregate isn't
+// counted as one of its elements, it's skipped and the element it annotates is returned.
+func (r *Parser) parseRESP3Element(depth int) ([]byte, *Command, error) {
+	typ := CommandType(r.buffer[r.parsePosition])
+	switch typ {
+	case Double, Boolean, BigNumber, Null:
+		r.parsePosition++
+		arg, e := r.readLine()
+		if e != nil {
+			return nil, nil, e
+		}
+		if typ == Null {
+			if len(arg) != 0 {
+				return nil, nil, ExpectNewLine
+			}
+			cmd := newScalar(Null, nil)
+			cmd.null = true
+			cmd.setNull(0)
+			return nil, cmd, nil
+		}
+		cmd := newScalar(typ, arg)
+		if typ == Boolean {
+			switch string(arg) {
+			case "t":
+				cmd.num = 1
+			case "f":
+			default:
+				return nil, nil, &ProtocolError{message: fmt.Sprintf("expect boolean, got %q", arg), cause: ExpectTypeChar}
+			}
+		}
+		return arg, cmd, nil
+	case Verbatim, BlobError:
+		arg, e := r.parseBulk()
+		if e != nil {
+			return nil, nil, e
+		}
+		return arg, newScalar(typ, arg), nil
+	}
+	if depth >= r.nesting {
+		return nil, nil, InvalidNesting
+	}
+	child, e := r.parseAggregate(depth + 1)
+	if e != nil || typ != Attribute {
+		return nil, child, e
+	}
+	return r.parseElement(depth)
+}
+
+// readRESP3 reads a top-level frame of one of the RESP3 only types, attributes are returned as frames of their own
+// ahead of the reply they annotate.
+func (r *Parser) readRESP3() (*Command, error) {
+	if resp3Aggregate(r.buffer[r.parsePosition]) {
+		return r.parseAggregate(0)
 	}
-	argv := make([][]byte, 0, numArg)
-	for i := 0; i < numArg; i++ {
-		if e = r.requireNBytes(1); e != nil {
+	_, cmd, err := r.parseRESP3Element(0)
+	return cmd, err
+}
+
+// parseReply reads a top-level reply frame other than an array.
+func (r *Parser) parseReply() (*Command, error) {
+	arg, cmd, err := r.parseElement(0)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == nil {
+		cmd = newBulk(arg)
+		cmd.streamed = r.buffer[r.cmdBegin+1] == '?'
+	}
+	return cmd, nil
+}
+
+func (r *Parser) maxBulkSize() int64 {
+	return r.bulkSize
+}
+
+func (r *Parser) maxNumArg() int {
+	if r.maxArgs > 0 {
+		return r.maxArgs
+	}
+	return r.numArgs
+}
+
+// checkCommandSize fails if consuming extra more bytes makes the current command exceed MaxCommandBytes.
+func (r *Parser) checkCommandSize(extra int) error {
+	limit := r.opts.MaxCommandBytes
+	if r.maxBytes > 0 {
+		limit = r.maxBytes
+	}
+	if limit > 0 && r.parsePosition-r.cmdBegin+extra > limit {
+		return ErrCommandTooLarge
+	}
+	return nil
+}
+
+// parseString reads a bulk string, the returned data points into the read buffer.
+func (r *Parser) parseString() ([]byte, error) {
+	if e := r.requireNBytes(1); e != nil {
+		return nil, e
+	}
+	if r.buffer[r.parsePosition] != '$' {
+		return nil, ExpectTypeChar
+	}
+	return r.parseBulk()
+}
+
+// parseBulk reads a length prefixed string after its type char, '$' or the RESP3 '=' and '!'.
+func (r *Parser) parseBulk() ([]byte, error) {
+	r.parsePosition++
+	plen, streamed, e := r.readLength()
+	if e != nil {
+		return nil, e
+	}
+	if streamed {
+		return r.parseStreamedString()
+	}
+	var arg []byte
+	switch {
+	case plen == -1:
+		return nil, nil // null bulk, no data nor trailing CRLF follows
+	case plen >= 0 && plen <= r.maxBulkSize():
+		n := int(plen)
+		if e = r.checkCommandSize(n + 2); e != nil {
+			return nil, e
+		}
+		if e = r.requireNBytes(n); e != nil {
+			return nil, e
+		}
+		// capped so appending to an argument copies it rather than writing over the bytes following it, and
+		// an empty bulk is an empty slice of the buffer like any other, not nil
+		arg = r.buffer[r.parsePosition : r.parsePosition+n : r.parsePosition+n]
+		r.parsePosition += n
+	case plen > 0:
+		return nil, r.bulkTooLarge(plen)
+	default:
+		return nil, InvalidBulkSize
+	}
+	if e = r.discardNewLine(); e != nil {
+		return nil, e
+	}
+	return arg, nil
+}
+
+// parseStreamedString reads the chunks of a RESP3 streamed string ($?) up to the empty chunk, the data is
+// assembled into a new slice as chunks aren't contiguous in the buffer.
+func (r *Parser) parseStreamedString() ([]byte, error) {
+	data := []byte{}
+	for {
+		if e := r.requireNBytes(1); e != nil {
 			return nil, e
 		}
-		if r.buffer[r.parsePosition] != '$' {
+		if r.buffer[r.parsePosition] != ';' {
 			return nil, ExpectTypeChar
 		}
 		r.parsePosition++
-		var plen int
-		if plen, e = r.readNumber(); e != nil {
+		clen, e := r.readNumber()
+		if e != nil {
 			return nil, e
 		}
 		if e = r.discardNewLine(); e != nil {
 			return nil, e
 		}
-		switch {
-		case plen == -1:
-			argv = append(argv, nil) // null bulk
-		case plen == 0:
-			argv = append(argv, emptyBulk[:]) // empty bulk
-		case plen > 0 && plen <= MaxBulkSize:
-			if e = r.requireNBytes(plen); e != nil {
-				return nil, e
-			}
-			argv = append(argv, r.buffer[r.parsePosition:(r.parsePosition+plen)])
-			r.parsePosition += plen
-		default:
+		if clen == 0 {
+			return data, nil
+		}
+		if clen < 0 {
 			return nil, InvalidBulkSize
 		}
+		if int64(len(data))+clen > r.maxBulkSize() {
+			return nil, r.bulkTooLarge(int64(len(data)) + clen)
+		}
+		n := int(clen)
+		if e = r.checkCommandSize(n + 2); e != nil {
+			return nil, e
+		}
+		if e = r.requireNBytes(n); e != nil {
+			return nil, e
+		}
+		data = append(data, r.buffer[r.parsePosition:r.parsePosition+n]...)
+		r.parsePosition += n
 		if e = r.discardNewLine(); e != nil {
 			return nil, e
 		}
 	}
-	return &Command{argv: argv}, nil
+}
+
+// readLength reads the length following the type char of an aggregate or bulk string, streamed is true for
+// the RESP3 unknown length '?', which RESP2 doesn't have: without SetProtocolVersion(3) it fails with
+// ExpectNumber.
+func (r *Parser) readLength() (int64, bool, error) {
+	if e := r.requireNBytes(1); e != nil {
+		return 0, false, e
+	}
+	if r.buffer[r.parsePosition] == '?' && r.resp3 {
+		r.parsePosition++
+		return -1, true, r.discardNewLine()
+	}
+	n, e := r.readNumber()
+	if e != nil {
+		return 0, false, e
+	}
+	return n, false, r.discardNewLine()
+}
+
+// frameHook runs ParserOptions.OnFrame on the frame at parsePosition, it fails with ErrStreamTransition when
+// the hook stops there.
+func (r *Parser) frameHook() error {
+	if r.opts.OnFrame == nil {
+		return nil
+	}
+	header, err := r.peekHeader()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if r.opts.OnFrame(r.buffer[r.parsePosition], header) {
+		return ErrStreamTransition
+	}
+	return nil
+}
+
+// peekHeader returns the first line of the frame at parsePosition for OnFrame, without its type char and line
+// ending and without consuming it.
+func (r *Parser) peekHeader() ([]byte, error) {
+	for {
+		if i := bytes.IndexByte(r.buffer[r.parsePosition:r.writeIndex], '\n'); i >= 0 {
+			end := r.parsePosition + i
+			if end > r.parsePosition && r.buffer[end-1] == '\r' {
+				end--
+			}
+			begin := min(r.parsePosition+1, end)
+			return r.buffer[begin:end:end], nil
+		}
+		if r.writeIndex-r.parsePosition > r.lineSize {
+			return nil, LineTooLong
+		}
+		if e := r.readSome(1); e != nil {
+			return nil, e
+		}
+	}
+}
+
+// readLine reads a CRLF terminated line, the returned data excludes the CRLF and points into the read buffer.
+func (r *Parser) readLine() ([]byte, error) {
+	for {
+		if i := bytes.Index(r.buffer[r.parsePosition:r.writeIndex], newLine); i >= 0 {
+			line := r.buffer[r.parsePosition : r.parsePosition+i : r.parsePosition+i]
+			r.parsePosition += i + 2
+			return line, nil
+		}
+		if r.writeIndex-r.parsePosition > r.lineSize {
+			return nil, LineTooLong
+		}
+		if e := r.readSome(1); e != nil {
+			return nil, e
+		}
+	}
 }
 
 func (r *Parser) parseTelnet() (*Command, error) {
 	nlPos := -1
 	for {
-		nlPos = bytes.IndexByte(r.buffer, '\n')
-		if nlPos == -1 {
-			if e := r.readSome(1); e != nil {
-				return nil, e
-			}
+		line := r.buffer[r.parsePosition:r.writeIndex]
+		if r.opts.LenientNewline {
+			nlPos = bytes.IndexAny(line, "\r\n")
 		} else {
+			nlPos = bytes.IndexByte(line, '\n')
+		}
+		// the line only: earlier commands can still be buffered before it and pipelined ones after it
+		if nlPos >= 0 {
+			if nlPos > r.telnetLine {
+				return nil, LineTooLong
+			}
 			break
 		}
-		if r.writeIndex > MaxTelnetLine {
+		if len(line) > r.telnetLine {
 			return nil, LineTooLong
 		}
+		if e := r.readSome(1); e != nil {
+			return nil, e
+		}
 	}
-	r.parsePosition = r.writeIndex // we don't support pipeline in telnet mode
-	return &Command{argv: bytes.Split(r.buffer[:nlPos-1], spaceSlice)}, nil
+	nlPos += r.parsePosition
+	end := nlPos
+	if r.buffer[nlPos] == '\r' {
+		// bare \r terminator, also consume the \n of a \r\n either buffered or arriving in the next read
+		if nlPos+1 < r.writeIndex {
+			if r.buffer[nlPos+1] == '\n' {
+				nlPos++
+			}
+		} else {
+			r.skipLF = true
+		}
+	} else if end > r.parsePosition && r.buffer[end-1] == '\r' {
+		end--
+	}
+	line := r.buffer[r.parsePosition:end]
+	r.parsePosition = nlPos + 1
+	if e := r.checkCommandSize(0); e != nil {
+		return nil, e
+	}
+	var argv [][]byte
+	if r.opts.QuotedInline {
+		var e error
+		if argv, e = splitQuoted(line); e != nil {
+			return nil, e
+		}
+	} else if r.opts.PreserveEmptyFields {
+		if len(bytes.Trim(line, " ")) != 0 {
+			argv = bytes.Split(line[:len(line):len(line)], spaceSlice)
+		}
+	} else {
+		argv = bytes.FieldsFunc(line, isInlineSpace)
+	}
+	if len(argv) == 0 {
+		if r.opts.KeepBlankInline {
+			return &Command{argv: [][]byte{}, typ: Multi, inline: true}, nil
+		}
+		return nil, nil // blank line, like redis ignore it
+	}
+	if len(argv) > r.maxNumArg() {
+		return nil, r.tooManyArgs(int64(len(argv)))
+	}
+	if r.opts.StrictInline {
+		for _, c := range line {
+			if (c < ' ' && c != '\t') || c == 0x7f {
+				return nil, &ProtocolError{message: fmt.Sprintf("Invalid Inline: control byte %q", c), cause: InvalidInline}
+			}
+		}
+	}
+	if r.opts.ValidateUTF8 && !utf8.Valid(line) {
+		return nil, &ProtocolError{message: "invalid UTF-8 in inline command", cause: ErrInvalidUTF8}
+	}
+	return &Command{argv: argv, typ: Multi, inline: true}, nil
+}
+
+func isInlineSpace(c rune) bool {
+	return c == ' ' || c == '\t'
+}
+
+var errUnbalancedQuotes = &ProtocolError{message: "Invalid Inline: unbalanced quotes", cause: InvalidInline}
+
+// splitQuoted splits an inline line honouring quotes, see ParserOptions.QuotedInline. Arguments without quotes
+// point into line, the others are copied as unquoting changes them.
+func splitQuoted(line []byte) ([][]byte, error) {
+	var argv [][]byte
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(rune(line[i])) {
+			i++
+		}
+		if i == len(line) {
+			return argv, nil
+		}
+		start := i
+		var arg []byte
+		copied := false
+		for i < len(line) && !isInlineSpace(rune(line[i])) {
+			if c := line[i]; c != '"' && c != '\'' {
+				if copied {
+					arg = append(arg, c)
+				}
+				i++
+				continue
+			}
+			if !copied {
+				// a quote can open in the middle of an argument, a"b c" is `ab c` like in redis
+				arg = append(make([]byte, 0, len(line)-start), line[start:i]...)
+				copied = true
+			}
+			var ok bool
+			if arg, i, ok = unquote(arg, line, i); !ok || i < len(line) && !isInlineSpace(rune(line[i])) {
+				return nil, errUnbalancedQuotes
+			}
+		}
+		if !copied {
+			arg = line[start:i:i]
+		}
+		argv = append(argv, arg)
+	}
+}
+
+// unquote appends to dst the content of the quoted string starting at line[i] and returns the index following
+// the closing quote, ok is false when the string isn't closed.
+func unquote(dst, line []byte, i int) ([]byte, int, bool) {
+	q := line[i]
+	for i++; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == q:
+			return dst, i + 1, true
+		case c == '\\' && q == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			c = '\''
+			i++
+		case c == '\\' && q == '"' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+			c = unhex(line[i+2])<<4 | unhex(line[i+3])
+			i += 3
+		case c == '\\' && q == '"' && i+1 < len(line):
+			i++
+			switch c = line[i]; c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'a':
+				c = '\a'
+			}
+		}
+		dst = append(dst, c)
+	}
+	return dst, i, false
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c >= 'a':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
 }
 
 func (r *Parser) reset() {
+	r.base += int64(r.writeIndex)
 	r.writeIndex = 0
 	r.parsePosition = 0
-	//r.buffer = make([]byte, len(r.buffer))
+	r.cmdBegin = 0
+	if r.opts.ReleaseLargeBuffers || (r.opts.ShrinkAfter > 0 && r.smallRun >= r.opts.ShrinkAfter) {
+		r.ResetAndRelease()
+	}
+}
+
+// ResetAndRelease replaces a read buffer grown past its initial size with a fresh one, carrying over the bytes
+// not parsed yet, so the large backing array becomes collectable once the commands pointing into it are
+// dropped. Call it between commands, not from an OnCommand hook.
+func (r *Parser) ResetAndRelease() {
+	if cap(r.buffer) <= r.initSize {
+		return
+	}
+	// commands returned earlier still point into the old buffer, so allocate rather than reslice
+	pending := r.writeIndex - r.parsePosition
+	buffer := make([]byte, max(r.initSize, pending))
+	copy(buffer, r.buffer[r.parsePosition:r.writeIndex])
+	r.base += int64(r.parsePosition)
+	r.buffer = buffer
+	r.parsePosition = 0
+	r.writeIndex = pending
+	r.cmdBegin = 0
+	r.smallRun = 0
 }
 
+// Reset makes the parser read from reader as if newly created with the same options and limits, keeping its
+// read buffer and the types added with RegisterType, so a server can reuse parsers across connections (see
+// ParserPool). Buffered data, the protocol version, Stats and any unread or partial command are dropped.
+// Commands read before are only valid until Reset as the buffer is reused.
+func (r *Parser) Reset(reader io.Reader) {
+	bufr, _ := reader.(*bufio.Reader)
+	*r = Parser{reader: reader, buffer: r.buffer, initSize: r.initSize, opts: r.opts, bufr: bufr, argv: r.argv,
+		numArgs: r.numArgs, bulkSize: r.bulkSize, telnetLine: r.telnetLine, lineSize: r.lineSize, nesting: r.nesting, growSize: r.growSize,
+		types: r.types}
+}
+
+// ReadCommand reads the next command. It returns io.EOF only when the stream is closed at a command boundary,
+// a stream closed in the middle of a command gives io.ErrUnexpectedEOF. When that command is a multi-bulk one
+// whose header was read, the error wraps ErrIncompleteArray and tells how many arguments arrived; use errors.Is
+// to check for either.
+// A protocol error (ExpectNumber, ExpectTypeChar, InvalidBulkSize and the like, see ParserStats.ProtocolErrors)
+// leaves the parser wherever the malformed byte was found, e.g. on the 'x' of "$x\r\n", so the rest of the
+// frame would be read as garbage. The stream is out of sync and the connection should be closed, like redis
+// does, rather than read again, unless Resync can find the next command.
 func (r *Parser) ReadCommand() (*Command, error) {
+	return r.ReadFrame()
+}
+
+// ReadFrame reads the next frame whatever its direction, for a connection carrying both commands and replies
+// like a replica's link to its master. It's ReadCommand under another name: in ModeClient both multi-bulk
+// commands and replies are accepted and Command.Type tells what was read, Multi for a command or an array reply,
+// Push for an out of band RESP3 push, Status, Error, Number, Bulk and the other RESP3 types for replies. The two
+// directions can't be told apart on the wire beyond that, an array reply looks like a command. In ModeAny the
+// reply type chars start inline commands instead. Like ReadCommand it's not safe for concurrent use.
+func (r *Parser) ReadFrame() (*Command, error) {
+	if cmd := r.unread; cmd != nil {
+		r.unread = nil
+		return cmd, nil
+	}
+	cmd, err := r.readCommand()
+	if err != nil {
+		if isProtocolError(err) {
+			r.protoErrors++
+		}
+		if err != io.EOF && err != errNeedMore && r.opts.OnError != nil {
+			r.opts.OnError(err)
+		}
+	} else {
+		if r.opts.CopyOnRead {
+			copied := cmd.Copy()
+			cmd.Release()
+			cmd = copied
+		}
+		r.commands++
+		if r.opts.OnCommand != nil {
+			r.opts.OnCommand(cmd)
+		}
+	}
+	return cmd, err
+}
+
+// Unread makes the next ReadCommand return cmd again without reading, e.g. for a dispatcher handing a command
+// it peeked at over to another handler. Hooks and Stats don't see it a second time. Only one command can be
+// pending, unreading another before it's read fails with ErrInvalidUnread. If cmd points into the read buffer
+// it stays valid until it's returned again, as nothing is read meanwhile.
+func (r *Parser) Unread(cmd *Command) error {
+	if r.unread != nil {
+		return ErrInvalidUnread
+	}
+	r.unread = cmd
+	return nil
+}
+
+// Resync skips to the next plausible frame boundary after ReadCommand failed with a protocol error, so the
+// connection can go on instead of being closed. It discards bytes up to a line start where a frame the parser
+// accepts can begin: any line when inline commands are accepted, since they're newline delimited, otherwise
+// one starting with a type char allowed at the top level, e.g. '*'. A boundary right where the failed command
+// left off is kept, e.g. the command after a rejected "*0\r\n". Inline streams recover reliably, after an error
+// in a binary frame it's best effort, a bulk payload can contain a line that looks like a frame. It returns
+// io.EOF when the stream ends first.
+func (r *Parser) Resync() error {
+	r.unread, r.partial = nil, nil
+	atLine := r.errAtLine
+	for {
+		if r.parsePosition >= r.writeIndex {
+			// nothing left to scan, drop it rather than grow the buffer while reading on
+			r.reset()
+			if err := r.readSome(1); err != nil {
+				return err
+			}
+		}
+		if atLine && r.frameStart(r.buffer[r.parsePosition]) {
+			r.cmdBegin = r.parsePosition
+			return nil
+		}
+		if i := bytes.IndexByte(r.buffer[r.parsePosition:r.writeIndex], '\n'); i >= 0 {
+			r.parsePosition += i + 1
+			atLine = true
+		} else {
+			r.parsePosition = r.writeIndex
+			atLine = false
+		}
+	}
+}
+
+// frameStart tells whether a frame the parser accepts at the top level can start with c.
+func (r *Parser) frameStart(c byte) bool {
+	return r.negotiated(c) || !r.opts.DisableInline && r.opts.Mode != ModeClient
+}
+
+// ReadCommandNonBlocking works like ReadCommand making at most one call to Read on the reader, for event loops
+// that must not wait on a connection more than once per readiness notification. The bool tells whether a
+// command was complete, when it's false with a nil error the data received so far is kept and the command is
+// parsed again from its start by the next call, so a large command arriving in many small reads costs more
+// than with ReadCommand. Errors are those of ReadCommand. A Read returning no data and no error counts as no
+// command yet.
+func (r *Parser) ReadCommandNonBlocking() (*Command, bool, error) {
+	r.oneRead, r.reads = true, 0
+	cmd, err := r.ReadCommand()
+	r.oneRead = false
+	if err == errNeedMore {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return cmd, true, nil
+}
+
+// ReadCommandTimeout works like ReadCommand giving up after d, it fails with an error wrapping ErrReadTimeout
+// when the command isn't complete in time. It needs a reader with SetReadDeadline like a net.Conn, any other
+// returns ErrNoDeadline. d bounds the whole command, ParserOptions.ReadTimeout still applies to each read.
+// After a timeout in the middle of a command the stream is out of sync, the connection should be closed.
+func (r *Parser) ReadCommandTimeout(d time.Duration) (*Command, error) {
+	conn, ok := r.reader.(deadlineReader)
+	if !ok {
+		return nil, ErrNoDeadline
+	}
+	r.deadline = time.Now().Add(d)
+	defer func() {
+		r.deadline = time.Time{}
+		if r.opts.ReadTimeout == 0 {
+			conn.SetReadDeadline(time.Time{})
+		}
+	}()
+	return r.ReadCommand()
+}
+
+func (r *Parser) readCommand() (*Command, error) {
+	for {
+		cmd, err := r.readFrame()
+		if cmd != nil || err != nil {
+			return cmd, err
+		}
+		// a blank line or the \n of a split \r\n, move on to the next frame
+	}
+}
+
+// readFrame reads the next frame, it returns neither a command nor an error when it only consumed a blank
+// inline line.
+func (r *Parser) readFrame() (*Command, error) {
+	r.partial = nil
+	r.pending, r.bulk = 0, nil
+	r.dataToken = false
 	// if the buffer is empty, try to fetch some
 	if r.parsePosition >= r.writeIndex {
 		if err := r.readSome(1); err != nil {
 			return nil, err
 		}
 	}
+	if r.skipLF {
+		// the previous inline command ended with a bare \r, drop the \n of a \r\n split across reads
+		r.skipLF = false
+		if r.buffer[r.parsePosition] == '\n' {
+			r.parsePosition++
+			if r.parsePosition >= r.writeIndex {
+				r.reset()
+			}
+			return nil, nil
+		}
+	}
 
 	var cmd *Command
 	var err error
-	if r.buffer[r.parsePosition] == '*' {
-		cmd, err = r.parseBinary()
-	} else {
+	r.cmdBegin = r.parsePosition
+	if err := r.frameHook(); err != nil {
+		return nil, err
+	}
+	if c := r.buffer[r.parsePosition]; r.opts.LockProtocol && r.versionSet && !r.negotiated(c) {
+		version := 2
+		if r.resp3 {
+			version = 3
+		}
+		return nil, &ProtocolError{message: fmt.Sprintf("redisproto: protocol violation, %q frame after negotiating RESP%d",
+			c, version), cause: ErrProtocolViolation}
+	}
+	switch c := r.buffer[r.parsePosition]; {
+	case c == '*':
+		if r.opts.MaxCommandBytes == 0 && r.maxBytes == 0 {
+			cmd = r.parseFast()
+		}
+		if cmd == nil {
+			cmd, err = r.parseBinary()
+		}
+	case (c == '$' || c == ':' || c == '+' || c == '-') && r.opts.Mode != ModeAny:
+		if r.opts.Mode == ModeServer {
+			err = ExpectTypeChar
+		} else {
+			cmd, err = r.parseReply()
+		}
+	case resp3Type(c) && r.resp3 && r.opts.Mode == ModeClient:
+		cmd, err = r.readRESP3()
+	case c == '#' && r.opts.SkipComments && !r.resp3:
+		_, err = r.readTokenLine() // a comment, no command
+	case r.types[c] != nil:
+		cmd, err = r.parseCustom(r.types[c])
+	case r.opts.Mode == ModeClient:
+		err = ExpectTypeChar
+	case r.opts.DisableInline || resp3Type(c):
+		// a RESP3 frame the connection didn't negotiate is a desynced or confused peer, not a telnet command
+		err = &ProtocolError{message: fmt.Sprintf("expect type char, got %q", c), cause: ExpectTypeChar}
+	default:
 		cmd, err = r.parseTelnet()
 	}
+	if err == errNeedMore {
+		// a FrameParser ran out of data, the command is parsed again from its start once more is fed
+		r.parsePosition = r.cmdBegin
+		return nil, err
+	}
+	if err == io.EOF {
+		// the stream ended in the middle of a command
+		err = io.ErrUnexpectedEOF
+	}
+	if cmd != nil && cmd.bytes == 0 {
+		cmd.alloc = r.opts.Allocator
+		// requestSpace moves cmdBegin along with the data when it grows or compacts the buffer mid command, so
+		// both ends are in the same buffer here
+		cmd.raw = r.buffer[r.cmdBegin:r.parsePosition]
+		cmd.bytes = r.parsePosition - r.cmdBegin
+		if cmd.bytes <= cap(r.buffer)/4 {
+			r.smallRun++
+		} else {
+			r.smallRun = 0
+		}
+	}
+	// kept for Resync as reset drops the bytes before the error
+	r.errAtLine = err != nil && r.parsePosition > r.cmdBegin && r.buffer[r.parsePosition-1] == '\n'
 	if r.parsePosition >= r.writeIndex {
 		if cmd != nil {
 			cmd.last = true
@@ -261,6 +1671,79 @@ func (r *Parser) ReadCommand() (*Command, error) {
 	return cmd, err
 }
 
+// ReadCommandLimited works like ReadCommand with MaxNumArg and ParserOptions.MaxCommandBytes replaced by maxArgs
+// and maxBytes for this one command, inline or multi-bulk, e.g. to tighten limits for untrusted clients. A value
+// of zero or less keeps the parser-wide limit.
+func (r *Parser) ReadCommandLimited(maxArgs, maxBytes int) (*Command, error) {
+	r.maxArgs, r.maxBytes = maxArgs, maxBytes
+	defer func() {
+		r.maxArgs, r.maxBytes = 0, 0
+	}()
+	return r.ReadCommand()
+}
+
+// ReadCommands reads up to n commands in one call, it stops early after the command that drains the receive
+// buffer so it never blocks waiting for more data than already available (except for the first command).
+// Returned commands are copied and stay valid after subsequent reads, they're never pooled and need no Release
+// even with PoolCommands. On a parse error the commands read so far are returned along with the error. An n of
+// zero or less reads all the commands already available.
+func (r *Parser) ReadCommands(n int) ([]*Command, error) {
+	// n is only an upper bound, don't let a large one allocate ahead of what the buffer holds
+	cmds := make([]*Command, 0, min(max(n, 1), 64))
+	for n <= 0 || len(cmds) < n {
+		cmd, err := r.ReadCommand()
+		if err != nil {
+			return cmds, err
+		}
+		if cmd != nil {
+			// the copy is what the caller keeps, a pooled original goes back to the pool
+			copied := cmd.Copy()
+			cmd.Release()
+			cmds = append(cmds, copied)
+		}
+		if r.parsePosition >= r.writeIndex {
+			break
+		}
+	}
+	return cmds, nil
+}
+
+// ParseCommand parses a single command from the front of data and returns it along with the number of bytes
+// it consumed, blank lines skipped before it included. The command is copied out of data so it stays valid
+// after data is reused. It returns io.ErrUnexpectedEOF (possibly wrapped, see ReadCommand) when data holds only
+// a partial frame. data is parsed in place, without copying, so replaying a buffer command by command costs
+// only the copies of the commands.
+func ParseCommand(data []byte) (*Command, int, error) {
+	parser := newParser(nil, 0, ParserOptions{})
+	parser.buffer, parser.writeIndex = data[:len(data):len(data)], len(data)
+	parser.oneRead, parser.reads = true, 1 // the end of data is the end of the stream, never read nor grow
+	cmd, err := parser.ReadCommand()
+	if err != nil {
+		if err == io.EOF || err == errNeedMore {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	return cmd.Copy(), int(parser.Position()), nil
+}
+
+// ReadAll reads every command from reader until io.EOF, each command is copied so the result can be retained.
+// On the first error other than io.EOF it returns the commands read so far along with the error.
+func ReadAll(reader io.Reader) ([]*Command, error) {
+	parser := NewParser(reader)
+	var cmds []*Command
+	for {
+		cmd, err := parser.ReadCommand()
+		if err == io.EOF {
+			return cmds, nil
+		}
+		if err != nil {
+			return cmds, err
+		}
+		cmds = append(cmds, cmd.Copy())
+	}
+}
+
 func (r *Parser) Commands() <-chan *Command {
 	cmds := make(chan *Command)
 	go func() {
@@ -272,3 +1755,25 @@ func (r *Parser) Commands() <-chan *Command {
 	}()
 	return cmds
 }
+
+// CommandsBuffered works like Commands but sends the commands in batches read with ReadCommands, copied so they
+// stay valid while the parser reads on. n bounds both the commands in a batch and the batches waiting in the
+// channel, batching cuts the channel cost per command that dominates with small commands. The channel is
+// closed on the first error, io.EOF included.
+func (r *Parser) CommandsBuffered(n int) <-chan []*Command {
+	n = max(n, 1)
+	batches := make(chan []*Command, n)
+	go func() {
+		defer close(batches)
+		for {
+			cmds, err := r.ReadCommands(n)
+			if len(cmds) > 0 {
+				batches <- cmds
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return batches
+}
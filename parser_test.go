@@ -0,0 +1,1878 @@
+package redisproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// resp3 switches parser to RESP3, for the frames only RESP3 allows like streamed aggregates.
+func resp3(parser *Parser) *Parser {
+	parser.SetProtocolVersion(3)
+	return parser
+}
+
+// newReplyParser creates a parser reading replies, reply frames are only parsed at the top level in ModeClient.
+func newReplyParser(reader io.Reader) *Parser {
+	return NewParserWithOptions(reader, ParserOptions{Mode: ModeClient})
+}
+
+func TestParser_ReadCommands(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$4\r\nLLEN\r\n$1\r\nb\r\n"
+	parser := NewParser(strings.NewReader(input))
+	cmds, err := parser.ReadCommands(10)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(cmds) != 3 {
+		t.Fatalf("Unexpected number of commands %d", len(cmds))
+	}
+	if !cmds[2].IsLast() || cmds[0].IsLast() {
+		t.Errorf("Unexpected IsLast flags")
+	}
+	if string(cmds[1].Get(1)) != "a" || string(cmds[2].Get(0)) != "LLEN" {
+		t.Errorf("Unexpected command arguments")
+	}
+}
+
+func TestParser_ReadCommandsMax(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nQUIT\r\n"
+	parser := NewParser(strings.NewReader(input))
+	cmds, err := parser.ReadCommands(2)
+	if err != nil || len(cmds) != 2 {
+		t.Fatalf("Unexpected result %d %v", len(cmds), err)
+	}
+	cmds, err = parser.ReadCommands(2)
+	if err != nil || len(cmds) != 1 || string(cmds[0].Get(0)) != "QUIT" {
+		t.Fatalf("Unexpected result %d %v", len(cmds), err)
+	}
+	for _, n := range []int{0, -1} {
+		cmds, err = NewParser(strings.NewReader(input)).ReadCommands(n)
+		if err != nil || len(cmds) != 3 {
+			t.Errorf("Unexpected result %d %v for n %d", len(cmds), err, n)
+		}
+	}
+}
+
+func TestParser_ReadCommandsError(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n*1\r\n#4\r\nPING\r\n"
+	parser := NewParser(strings.NewReader(input))
+	cmds, err := parser.ReadCommands(10)
+	if !errors.Is(err, ExpectTypeChar) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(cmds) != 1 || !bytes.Equal(cmds[0].Get(0), []byte("PING")) {
+		t.Errorf("Unexpected commands read before error")
+	}
+}
+
+func TestCommand_Encode(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$0\r\n\r\n"
+	cmd, err := NewParser(strings.NewReader(input)).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	buff := bytes.NewBuffer(nil)
+	if _, err = cmd.Encode(buff); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if buff.String() != input {
+		t.Errorf("Unexpected encoding %q", buff.String())
+	}
+	again, err := NewParser(buff).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if again.ArgCount() != cmd.ArgCount() {
+		t.Fatalf("Unexpected argument count %d", again.ArgCount())
+	}
+	for i := 0; i < cmd.ArgCount(); i++ {
+		if !bytes.Equal(again.Get(i), cmd.Get(i)) {
+			t.Errorf("Unexpected argument %d: %q", i, again.Get(i))
+		}
+	}
+}
+
+func TestCommand_Raw(t *testing.T) {
+	first := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	second := "*1\r\n$4\r\nPING\r\n"
+	parser := NewParser(strings.NewReader(first + second))
+	cmd, err := parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(cmd.Raw()) != first || cmd.Len() != len(first) {
+		t.Errorf("Unexpected raw bytes %q", cmd.Raw())
+	}
+	copied := cmd.Copy()
+	cmd, err = parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(cmd.Raw()) != second || cmd.Len() != len(second) {
+		t.Errorf("Unexpected raw bytes %q", cmd.Raw())
+	}
+	if string(copied.Raw()) != first {
+		t.Errorf("Unexpected raw bytes of copy %q", copied.Raw())
+	}
+}
+
+func TestParser_NestedArray(t *testing.T) {
+	input := "*3\r\n$4\r\nXADD\r\n*2\r\n:1\r\n+OK\r\n-ERR bad\r\n"
+	cmd, err := NewParser(strings.NewReader(input)).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	children := cmd.Children()
+	if len(children) != 3 || cmd.ArgCount() != 3 {
+		t.Fatalf("Unexpected children %d", len(children))
+	}
+	if children[0].Type() != Bulk || string(children[0].Get(0)) != "XADD" || string(cmd.Get(0)) != "XADD" {
+		t.Errorf("Unexpected first element")
+	}
+	nested := children[1].Children()
+	if children[1].Type() != Multi || len(nested) != 2 || cmd.Get(1) != nil {
+		t.Fatalf("Unexpected nested element")
+	}
+	if nested[0].Type() != Number || nested[0].Int() != 1 {
+		t.Errorf("Unexpected nested number")
+	}
+	if nested[1].Type() != Status || string(nested[1].Get(0)) != "OK" {
+		t.Errorf("Unexpected nested status")
+	}
+	if children[2].Type() != Error || string(cmd.Get(2)) != "ERR bad" {
+		t.Errorf("Unexpected error element")
+	}
+	buff := bytes.NewBuffer(nil)
+	cmd.Encode(buff)
+	if buff.String() != input {
+		t.Errorf("Unexpected encoding %q", buff.String())
+	}
+}
+
+func TestParser_FlatArray(t *testing.T) {
+	cmd, err := NewParser(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\na\r\n")).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cmd.Children() != nil || cmd.ArgCount() != 2 {
+		t.Errorf("Unexpected children for all-bulk array")
+	}
+}
+
+func TestParser_NestingLimit(t *testing.T) {
+	input := strings.Repeat("*1\r\n", MaxNestedLevel+2) + ":1\r\n"
+	_, err := NewParser(strings.NewReader(input)).ReadCommand()
+	if err != InvalidNesting {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_Buffered(t *testing.T) {
+	parser := NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n"))
+	if parser.Buffered() != 0 {
+		t.Errorf("Unexpected buffered %d", parser.Buffered())
+	}
+	parser.ReadCommand()
+	if parser.Buffered() != 14 {
+		t.Errorf("Unexpected buffered %d", parser.Buffered())
+	}
+	parser.ReadCommand()
+	if parser.Buffered() != 0 {
+		t.Errorf("Unexpected buffered %d", parser.Buffered())
+	}
+}
+
+func TestParser_UnexpectedEOF(t *testing.T) {
+	_, err := NewParser(strings.NewReader("*2\r\n$4\r\nLLEN")).ReadCommand()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = NewParser(strings.NewReader("*2\r\n")).ReadCommand()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = NewParser(strings.NewReader("*2")).ReadCommand()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_IncompleteArray(t *testing.T) {
+	for data, msg := range map[string]string{
+		"*3\r\n$4\r\nPING\r\n":         "declared 3 elements but got 1",
+		"*3\r\n$4\r\nPING\r\n$2\r\nx":  "declared 3 elements but got 1",
+		"*2\r\n*2\r\n$1\r\na\r\n":      "declared 2 elements but got 0",
+		"*?\r\n$1\r\na\r\n$1\r\nb\r\n": "incomplete streamed array, got 2 elements",
+	} {
+		_, err := resp3(NewParser(strings.NewReader(data))).ReadCommand()
+		if !errors.Is(err, ErrIncompleteArray) || !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Unexpected error %v for %q", err, data)
+		}
+	}
+	// the server mode check of the next type char hits the end of stream first
+	_, err := NewParserWithOptions(strings.NewReader("*3\r\n$4\r\nPING\r\n"), ParserOptions{Mode: ModeServer}).ReadCommand()
+	if !errors.Is(err, ErrIncompleteArray) {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_LastPartial(t *testing.T) {
+	parser := NewParserWithOptions(strings.NewReader("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nval"), ParserOptions{PoolCommands: true})
+	if _, err := parser.ReadCommand(); !errors.Is(err, ErrIncompleteArray) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	partial := parser.LastPartial()
+	if partial == nil || partial.ArgCount() != 2 || string(partial.Get(0)) != "SET" || string(partial.Get(1)) != "k" {
+		t.Errorf("Unexpected partial command %v", partial)
+	}
+	parser = NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\n"))
+	if _, err := parser.ReadCommand(); err != nil || parser.LastPartial() != nil {
+		t.Errorf("Unexpected partial after a complete command %v", err)
+	}
+}
+
+func TestParser_DataWithEOF(t *testing.T) {
+	inputs := []string{"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "PING\r\n", ":10\r\n", "$3\r\nabc\r\n", "*?\r\n+a\r\n.\r\n"}
+	for _, input := range inputs {
+		// DataErrReader returns the last bytes of the input together with io.EOF
+		parser := NewParser(iotest.DataErrReader(strings.NewReader(input + input)))
+		if input[0] == ':' || input[0] == '$' {
+			parser = newReplyParser(iotest.DataErrReader(strings.NewReader(input + input)))
+		}
+		parser.SetProtocolVersion(3)
+		for i := 0; i < 2; i++ {
+			if cmd, err := parser.ReadCommand(); err != nil || cmd.Len() != len(input) {
+				t.Fatalf("Unexpected result for %q %v", input, err)
+			}
+		}
+		if _, err := parser.ReadCommand(); err != io.EOF {
+			t.Errorf("Unexpected error for %q %v", input, err)
+		}
+	}
+}
+
+func TestParser_CleanEOF(t *testing.T) {
+	parser := NewParser(strings.NewReader("*2\r\n$4\r\nLLEN\r\n$1\r\na\r\n"))
+	if _, err := parser.ReadCommand(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := parser.ReadCommand(); err != io.EOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_RejectEmptyCommands(t *testing.T) {
+	for _, opts := range []ParserOptions{{RejectEmptyCommands: true}, {Mode: ModeServer}} {
+		parser := NewParserWithOptions(strings.NewReader("*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n"), opts)
+		for _, msg := range []string{`"*0"`, `"*-1"`} {
+			if _, err := parser.ReadCommand(); !errors.Is(err, ErrEmptyCommand) || !strings.Contains(err.Error(), msg) {
+				t.Errorf("Unexpected error %v", err)
+			}
+		}
+		if cmd, err := parser.ReadCommand(); err != nil || !cmd.IsPing() {
+			t.Errorf("Unexpected command %v %v", cmd, err)
+		}
+	}
+	// replies and nested arrays keep them
+	parser := NewParserWithOptions(strings.NewReader("*0\r\n*-1\r\n*2\r\n*0\r\n*-1\r\n"), ParserOptions{Mode: ModeClient})
+	for i := 0; i < 3; i++ {
+		if _, err := parser.ReadCommand(); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+}
+
+func TestParser_AppendToArgument(t *testing.T) {
+	input := "*3\r\n$0\r\n\r\n$1\r\na\r\n$1\r\nb\r\nSET k v\r\n"
+	for _, p := range []*Parser{NewParser(strings.NewReader(input)),
+		NewParserWithOptions(strings.NewReader(input), ParserOptions{MaxCommandBytes: 1 << 20})} {
+		cmd, err := p.ReadCommand()
+		if err != nil || cmd.Get(0) == nil || cmd.IsNull(0) {
+			t.Fatalf("Unexpected empty bulk %v %v", cmd, err)
+		}
+		empty := append(cmd.Get(0), 'x')
+		grown := append(cmd.Get(1), "xxxxxxx"...)
+		if string(cmd.Get(0)) != "" || string(cmd.Get(2)) != "b" || string(empty) != "x" || string(grown) != "axxxxxxx" {
+			t.Errorf("Unexpected arguments after append %v", cmd)
+		}
+		inline, _ := p.ReadCommand()
+		append(inline.Get(2), "xxxxxx"...)[0] = 'V'
+		if string(inline.Get(2)) != "v" {
+			t.Errorf("Unexpected inline argument %q", inline.Get(2))
+		}
+	}
+}
+
+func TestParser_NullAndEmptyArray(t *testing.T) {
+	parser := NewParser(strings.NewReader("*0\r\n*-1\r\n*1\r\n$-1\r\n"))
+	cmd, err := parser.ReadCommand()
+	if err != nil || cmd == nil || cmd.IsNil() || cmd.ArgCount() != 0 {
+		t.Errorf("Unexpected empty array %v %v", cmd, err)
+	}
+	cmd, err = parser.ReadCommand()
+	if err != nil || cmd == nil || !cmd.IsNil() || cmd.ArgCount() != 0 {
+		t.Errorf("Unexpected null array %v %v", cmd, err)
+	}
+	cmd, err = parser.ReadCommand()
+	if err != nil || cmd == nil || cmd.IsNil() || cmd.ArgCount() != 1 || cmd.Get(0) != nil {
+		t.Fatalf("Unexpected array of null bulk %v %v", cmd, err)
+	}
+	if !cmd.IsLast() {
+		t.Errorf("Expect last command")
+	}
+}
+
+func TestParser_ShrinkAfter(t *testing.T) {
+	big := "*1\r\n$65536\r\n" + strings.Repeat("a", 65536) + "\r\n"
+	readers := []io.Reader{strings.NewReader(big)}
+	for i := 0; i < 3; i++ {
+		readers = append(readers, strings.NewReader("*1\r\n$4\r\nPING\r\n"))
+	}
+	parser := NewParserWithOptions(io.MultiReader(readers...), ParserOptions{ShrinkAfter: 2})
+	if _, err := parser.ReadCommand(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cap(parser.buffer) <= ReadBufferInitSize {
+		t.Fatalf("Expect buffer to grow")
+	}
+	parser.ReadCommand()
+	if cap(parser.buffer) <= ReadBufferInitSize {
+		t.Errorf("Unexpected shrink after one small command")
+	}
+	parser.ReadCommand()
+	if cap(parser.buffer) != ReadBufferInitSize {
+		t.Errorf("Expect buffer to shrink, got %d", cap(parser.buffer))
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected command after shrink %v", err)
+	}
+}
+
+func TestParser_ReleaseLargeBuffers(t *testing.T) {
+	big := "*1\r\n$65536\r\n" + strings.Repeat("a", 65536) + "\r\n"
+	parser := NewParserWithOptions(io.MultiReader(strings.NewReader(big), strings.NewReader("*1\r\n$4\r\nPING\r\n")),
+		ParserOptions{ReleaseLargeBuffers: true})
+	cmd, err := parser.ReadCommand()
+	if err != nil || len(cmd.Get(0)) != 65536 || cap(parser.buffer) != ReadBufferInitSize {
+		t.Fatalf("Expect buffer to be released after the big command %v %d", err, cap(parser.buffer))
+	}
+	if cmd, err = parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected command after release %v", err)
+	}
+
+	parser = NewParserSize(strings.NewReader(big+"*1\r\n$4\r\nPING\r\n"), 16)
+	if _, err = parser.ReadCommand(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	pos := parser.Position()
+	parser.ResetAndRelease()
+	if cap(parser.buffer) != 16 || parser.Position() != pos {
+		t.Errorf("Unexpected buffer after ResetAndRelease %d at %d", cap(parser.buffer), parser.Position())
+	}
+	if cmd, err = parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected pending command after release %v", err)
+	}
+}
+
+func TestParser_ModeAny(t *testing.T) {
+	input := ":12\r\n+OK\r\n-ERR no\r\n$3\r\nabc\r\n*1\r\n$4\r\nPING\r\nPING\r\n"
+	// the default reads reply type chars as inline commands, replies are only parsed in ModeClient
+	parser := NewParser(strings.NewReader(input))
+	for _, expect := range []string{"Multi [:12]", "Multi [+OK]", "Multi [-ERR no]", "Multi [$3]", "Multi [abc]",
+		"Multi [PING]", "Multi [PING]"} {
+		if cmd, err := parser.ReadCommand(); err != nil || cmd.String() != expect {
+			t.Fatalf("Unexpected command %v %v, expect %s", cmd, err, expect)
+		}
+	}
+	parser = NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeClient})
+	for i, typ := range []CommandType{Number, Status, Error, Bulk, Multi} {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if cmd.Type() != typ {
+			t.Errorf("Unexpected type %c of frame %d", cmd.Type(), i)
+		}
+	}
+	// a reply line is bounded by MaxLineSize, not by the bulk limit
+	parser = NewParserWithOptions(strings.NewReader("+"+strings.Repeat("x", 1<<20)), ParserOptions{Mode: ModeClient})
+	if _, err := parser.ReadCommand(); err != LineTooLong || cap(parser.buffer) > 4*MaxLineSize {
+		t.Errorf("Unexpected error %v with a buffer of %d", err, cap(parser.buffer))
+	}
+}
+
+func TestParser_PipelinedRepliesLast(t *testing.T) {
+	for _, input := range []string{":1\r\n:1\r\n:1\r\n", "+OK\r\n+OK\r\n+OK\r\n", "$1\r\na\r\n$-1\r\n-ERR x\r\n"} {
+		parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeClient})
+		for i := 0; i < 3; i++ {
+			cmd, err := parser.ReadCommand()
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if cmd.IsLast() != (i == 2) || cmd.Len() != len(cmd.Raw()) {
+				t.Errorf("Unexpected IsLast %v of reply %d in %q", cmd.IsLast(), i, input)
+			}
+		}
+	}
+}
+
+func TestParser_ModeServer(t *testing.T) {
+	for _, input := range []string{":1\r\n", "+OK\r\n", "$1\r\na\r\n", "-ERR\r\n"} {
+		parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeServer})
+		if _, err := parser.ReadCommand(); err != ExpectTypeChar {
+			t.Errorf("Unexpected error %v for %q", err, input)
+		}
+	}
+	parser := NewParserWithOptions(strings.NewReader("PING\r\n"), ParserOptions{Mode: ModeServer})
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected inline command %v", err)
+	}
+}
+
+func TestParser_ModeClient(t *testing.T) {
+	parser := NewParserWithOptions(strings.NewReader(":1\r\nPING\r\n"), ParserOptions{Mode: ModeClient})
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.Int() != 1 {
+		t.Errorf("Unexpected reply %v", err)
+	}
+	if _, err := parser.ReadCommand(); err != ExpectTypeChar {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_Hooks(t *testing.T) {
+	var commands, errs int
+	parser := NewParserWithOptions(strings.NewReader("*1\r\n$4\r\nPING\r\n*1\r\n#4\r\n"), ParserOptions{
+		OnCommand: func(cmd *Command) { commands++ },
+		OnError:   func(err error) { errs++ },
+	})
+	parser.ReadCommand()
+	parser.ReadCommand()
+	if commands != 1 || errs != 1 {
+		t.Errorf("Unexpected hook calls %d %d", commands, errs)
+	}
+	parser = NewParserWithOptions(strings.NewReader(""), parser.opts)
+	if _, err := parser.ReadCommand(); err != io.EOF || errs != 1 {
+		t.Errorf("Unexpected hook call on clean EOF")
+	}
+}
+
+func TestParser_NewParserSize(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$100\r\n" + strings.Repeat("k", 100) + "\r\n"
+	parser := NewParserSize(iotest.OneByteReader(strings.NewReader(input)), 8)
+	cmd, err := parser.ReadCommand()
+	if err != nil || len(cmd.Get(1)) != 100 {
+		t.Fatalf("Unexpected command %v", err)
+	}
+	for _, size := range []int{0, -1} {
+		parser = NewParserSize(strings.NewReader(input), size)
+		if cap(parser.buffer) != minBufferSize {
+			t.Errorf("Expect the buffer to start at %d for size %d, got %d", minBufferSize, size, cap(parser.buffer))
+		}
+		if cmd, err = parser.ReadCommand(); err != nil || len(cmd.Get(1)) != 100 {
+			t.Errorf("Unexpected command %v for size %d", err, size)
+		}
+	}
+}
+
+func BenchmarkNewParser(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewParser(strings.NewReader(""))
+	}
+}
+
+func BenchmarkNewParserSize(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewParserSize(strings.NewReader(""), 512)
+	}
+}
+
+func TestParser_ReuseArgv(t *testing.T) {
+	parser := NewParserWithOptions(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"),
+		ParserOptions{ReuseArgv: true})
+	first, _ := parser.ReadCommand()
+	if string(first.Get(1)) != "a" {
+		t.Fatalf("Unexpected first command")
+	}
+	second, _ := parser.ReadCommand()
+	if string(second.Get(1)) != "b" || &first.argv[0] != &second.argv[0] {
+		t.Errorf("Expect argv to be reused")
+	}
+}
+
+func TestParser_MaxCommandBytes(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$100\r\n" + strings.Repeat("v", 100) + "\r\n"
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{MaxCommandBytes: 64})
+	if _, err := parser.ReadCommand(); err != ErrCommandTooLarge {
+		t.Errorf("Unexpected error %v", err)
+	}
+	parser = NewParserWithOptions(strings.NewReader(input), ParserOptions{MaxCommandBytes: len(input)})
+	if _, err := parser.ReadCommand(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_ReadCommandLimited(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\nSET k v\r\nSET k " + strings.Repeat("v", 100) + "\r\n*1\r\n$4\r\nPING\r\n"
+	parser := NewParser(strings.NewReader(input))
+	if _, err := parser.ReadCommandLimited(2, 0); !errors.Is(err, InvalidNumArg) {
+		t.Errorf("Unexpected multi-bulk error %v", err)
+	}
+	parser = NewParser(strings.NewReader(input[len("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"):]))
+	if _, err := parser.ReadCommandLimited(2, 0); !errors.Is(err, InvalidNumArg) {
+		t.Errorf("Unexpected inline error %v", err)
+	}
+	if _, err := parser.ReadCommandLimited(0, 64); err != ErrCommandTooLarge {
+		t.Errorf("Unexpected inline size error %v", err)
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected command after limited reads %v", err)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	data := []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*1\r\n$4\r\nPING\r\n")
+	cmd, n, err := ParseCommand(data)
+	if err != nil || n != 20 {
+		t.Fatalf("Unexpected result %d %v", n, err)
+	}
+	copy(data, bytes.Repeat([]byte{'x'}, len(data)))
+	if string(cmd.Get(0)) != "GET" || string(cmd.Get(1)) != "a" {
+		t.Errorf("Expect command to be copied out of data")
+	}
+	// the blank lines skipped before the command count as consumed, so the caller resumes at the next one
+	data = []byte("\r\n\r\nPING\r\n*1\r\n$4\r\nPING\r\n")
+	for _, expect := range []int{10, 14} {
+		if cmd, n, err = ParseCommand(data); err != nil || n != expect || !cmd.EqualArgs([]byte("PING")) {
+			t.Fatalf("Unexpected result %v %d %v, expect %d bytes", cmd, n, err, expect)
+		}
+		data = data[n:]
+	}
+	for _, partial := range []string{"", "*2\r\n$3\r\nGET\r\n", "*2\r\n$3\r\nGE"} {
+		if _, _, err = ParseCommand([]byte(partial)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Unexpected error %v for %q", err, partial)
+		}
+	}
+}
+
+func BenchmarkParseCommand(b *testing.B) {
+	// one command off the front of a large buffer, the rest of it mustn't be copied
+	data := []byte(strings.Repeat("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n", 30000))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseCommand(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParser_ReadStatus(b *testing.B) {
+	parser := newReplyParser(&loopReader{data: []byte(strings.Repeat("+PONG\r\n", 100))})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParser_InlineLineEndings(t *testing.T) {
+	for _, input := range []string{"PING a\r", "PING a\n", "PING a\r\n"} {
+		parser := NewParserWithOptions(strings.NewReader(input+"*1\r\n$4\r\nECHO\r\n"), ParserOptions{LenientNewline: true})
+		cmd, err := parser.ReadCommand()
+		if err != nil || cmd.ArgCount() != 2 || string(cmd.Get(0)) != "PING" || string(cmd.Get(1)) != "a" {
+			t.Fatalf("Unexpected inline command for %q: %v", input, err)
+		}
+		cmd, err = parser.ReadCommand()
+		if err != nil || string(cmd.Get(0)) != "ECHO" {
+			t.Errorf("Unexpected next command for %q: %v", input, err)
+		}
+	}
+}
+
+func TestParser_BlankLines(t *testing.T) {
+	parser := NewParser(strings.NewReader("\n\n*1\r\n$4\r\nPING\r\n\r\n\n"))
+	cmd, err := parser.ReadCommand()
+	if err != nil || cmd == nil || string(cmd.Get(0)) != "PING" {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	if cmd, err = parser.ReadCommand(); err != io.EOF || cmd != nil {
+		t.Errorf("Unexpected trailing command %v %v", cmd, err)
+	}
+	commands, _ := ReadAll(strings.NewReader(strings.Repeat("\n", 100000) + "PING\n"))
+	if len(commands) != 1 {
+		t.Errorf("Unexpected commands %v", commands)
+	}
+}
+
+func TestParser_BlankInline(t *testing.T) {
+	input := "\r\n   \r\nPING\r\n"
+	cmd, err := NewParser(strings.NewReader(input)).ReadCommand()
+	if err != nil || cmd.ArgCount() != 1 || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Expect blank lines to be skipped %v %v", cmd, err)
+	}
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{KeepBlankInline: true})
+	for i, argc := range []int{0, 0, 1} {
+		if cmd, err = parser.ReadCommand(); err != nil || cmd.ArgCount() != argc || !cmd.Inline() {
+			t.Errorf("Unexpected command %d %v %v", i, cmd, err)
+		}
+	}
+}
+
+func TestParser_InlineSplitCRLF(t *testing.T) {
+	reader := io.MultiReader(strings.NewReader("PING\r"), strings.NewReader("\nECHO\r\n"))
+	parser := NewParserWithOptions(reader, ParserOptions{LenientNewline: true})
+	cmd, err := parser.ReadCommand()
+	if err != nil || string(cmd.Get(0)) != "PING" {
+		t.Fatalf("Unexpected command %v", err)
+	}
+	cmd, err = parser.ReadCommand()
+	if err != nil || cmd.ArgCount() != 1 || string(cmd.Get(0)) != "ECHO" {
+		t.Errorf("Unexpected command after split CRLF %v", err)
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	cmds, err := ReadAll(iotest.OneByteReader(strings.NewReader("*1\r\n$4\r\nPING\r\nECHO hi\r\n*1\r\n$4\r\nQUIT\r\n")))
+	if err != nil || len(cmds) != 3 {
+		t.Fatalf("Unexpected result %d %v", len(cmds), err)
+	}
+	if string(cmds[0].Get(0)) != "PING" || string(cmds[1].Get(1)) != "hi" || string(cmds[2].Get(0)) != "QUIT" {
+		t.Errorf("Unexpected commands")
+	}
+	cmds, err = ReadAll(strings.NewReader("*1\r\n$4\r\nPING\r\n*1\r\n#4\r\n"))
+	if !errors.Is(err, ExpectTypeChar) || len(cmds) != 1 {
+		t.Errorf("Unexpected result %d %v", len(cmds), err)
+	}
+}
+
+func TestParser_InlineLineTooLong(t *testing.T) {
+	set := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2000\r\n" + strings.Repeat("v", 2000) + "\r\n"
+	// the tail of the inline command arrives in a later read, after the large command
+	parser := NewParser(io.MultiReader(strings.NewReader(set+"PI"), strings.NewReader("NG\r\n")))
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.ArgCount() != 3 {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.IsPing() {
+		t.Fatalf("Unexpected inline command %v %v", cmd, err)
+	}
+	// the rest of the line arrives along with a pipeline longer than MaxTelnetLine, only the line counts
+	pipeline := "G\r\n" + strings.Repeat("PING\r\n", 200)
+	parser = NewParser(io.MultiReader(strings.NewReader("PIN"), strings.NewReader(pipeline)))
+	for i := 0; i < 201; i++ {
+		if cmd, err := parser.ReadCommand(); err != nil || !cmd.IsPing() {
+			t.Fatalf("Unexpected inline command %d %v %v", i, cmd, err)
+		}
+	}
+	for _, reader := range []io.Reader{
+		iotest.OneByteReader(strings.NewReader(strings.Repeat("x", 2*MaxTelnetLine) + "\r\n")),
+		strings.NewReader(strings.Repeat("x", 2*MaxTelnetLine) + "\r\n"),
+	} {
+		if _, err := NewParser(reader).ReadCommand(); err != LineTooLong {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+}
+
+func TestParser_InlineFields(t *testing.T) {
+	input := "SET  key   v\r\n  GET k  \r\nHGET\th \t f\r\n \t \r\nPING\r\n"
+	parser := NewParser(strings.NewReader(input))
+	for _, expect := range []string{"Multi [SET key v]", "Multi [GET k]", "Multi [HGET h f]", "Multi [PING]"} {
+		if cmd, err := parser.ReadCommand(); err != nil || cmd.String() != expect {
+			t.Errorf("Unexpected command %v %v, expect %s", cmd, err, expect)
+		}
+	}
+	parser = NewParserWithOptions(strings.NewReader(input), ParserOptions{PreserveEmptyFields: true})
+	for _, expect := range []string{"Multi [SET  key   v]", "Multi [  GET k  ]", "Multi [HGET\\x09h \\x09 f]"} {
+		if cmd, err := parser.ReadCommand(); err != nil || cmd.String() != expect {
+			t.Errorf("Unexpected command %v %v, expect %s", cmd, err, expect)
+		}
+	}
+	parser = NewParserWithOptions(strings.NewReader("SET\tk v\r\n"), ParserOptions{StrictInline: true})
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.ArgCount() != 3 {
+		t.Errorf("Expect tabs to be allowed in strict mode %v %v", cmd, err)
+	}
+	parser = NewParser(strings.NewReader("DEL" + strings.Repeat("  k", MaxNumArg-1) + "\r\n"))
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.ArgCount() != MaxNumArg {
+		t.Errorf("Unexpected command %v %v", cmd, err)
+	}
+}
+
+func TestParser_InlineMaxNumArg(t *testing.T) {
+	parser := NewParser(strings.NewReader("DEL" + strings.Repeat(" k", MaxNumArg) + "\r\nDEL" + strings.Repeat(" k", MaxNumArg-1) + "\r\n"))
+	if _, err := parser.ReadCommand(); !errors.Is(err, InvalidNumArg) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.ArgCount() != MaxNumArg {
+		t.Errorf("Unexpected command %v", err)
+	}
+}
+
+func TestParser_ElementError(t *testing.T) {
+	_, err := NewParser(strings.NewReader("*3\r\n$4\r\nLLEN\r\n$1\r\na\r\n#3\r\n")).ReadCommand()
+	if !errors.Is(err, ExpectTypeChar) || err.Error() != "array element 2: Expect TypeChar" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, ok := err.(*ProtocolError); !ok {
+		t.Errorf("Expect a ProtocolError")
+	}
+	parser := NewParserWithOptions(strings.NewReader("*2\r\n$4\r\nLLEN\r\n:3\r\n"), ParserOptions{Mode: ModeServer})
+	_, err = parser.ReadCommand()
+	if !errors.Is(err, ExpectTypeChar) || err.Error() != "array element 1: expect '$', got ':'" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	reads  int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.reader.Read(p)
+}
+
+func TestParser_ReadChunk(t *testing.T) {
+	defer func(size int) { ReadBufferInitSize = size }(ReadBufferInitSize)
+	ReadBufferInitSize = 16
+	input := strings.Repeat("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 50)
+	count := func(opts ParserOptions) int {
+		reader := &countingReader{reader: strings.NewReader(input)}
+		parser := NewParserWithOptions(reader, opts)
+		for i := 0; i < 50; i++ {
+			if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(1)) != "a" {
+				t.Fatalf("Unexpected command %d: %v", i, err)
+			}
+		}
+		return reader.reads
+	}
+	without, with := count(ParserOptions{}), count(ParserOptions{ReadChunk: 4096})
+	if with != 1 || with >= without {
+		t.Errorf("Unexpected read count %d with chunk, %d without", with, without)
+	}
+}
+
+func TestParser_ReadChunkShortReads(t *testing.T) {
+	input := strings.Repeat("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 10)
+	parser := NewParserWithOptions(iotest.HalfReader(strings.NewReader(input)), ParserOptions{ReadChunk: 4096})
+	for i := 0; i < 10; i++ {
+		if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(1)) != "a" {
+			t.Fatalf("Unexpected command %d: %v", i, err)
+		}
+	}
+}
+
+func TestParser_StrictInline(t *testing.T) {
+	input := "PING\x00x\r\nSET k\x01 v\r\nECHO hi\r\n"
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{StrictInline: true})
+	for i := 0; i < 2; i++ {
+		if _, err := parser.ReadCommand(); !errors.Is(err, InvalidInline) {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(1)) != "hi" {
+		t.Errorf("Unexpected command %v", err)
+	}
+	cmd, err := NewParser(strings.NewReader(input)).ReadCommand()
+	if err != nil || string(cmd.Get(0)) != "PING\x00x" {
+		t.Errorf("Unexpected lenient command %v", err)
+	}
+}
+
+func TestParser_DisableInline(t *testing.T) {
+	parser := NewParserWithOptions(strings.NewReader("X123\r\n"), ParserOptions{DisableInline: true})
+	_, err := parser.ReadCommand()
+	if !errors.Is(err, ExpectTypeChar) || !strings.Contains(err.Error(), "'X'") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	parser = NewParserWithOptions(strings.NewReader("*1\r\n$4\r\nPING\r\n"), ParserOptions{DisableInline: true})
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected command %v", err)
+	}
+}
+
+func TestParser_MaxBufferSize(t *testing.T) {
+	ping := "*1\r\n$4\r\nPING\r\n"
+	input := strings.Repeat(ping, 1000) + ":12345\r\n" + "*2\r\n$3\r\nGET\r\n$5000\r\n" + strings.Repeat("x", 5000) + "\r\n"
+	parser := NewParserWithOptions(iotest.HalfReader(strings.NewReader(input)), ParserOptions{MaxBufferSize: 4096, Mode: ModeClient})
+	for i := 0; i < 1000; i++ {
+		if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "PING" || string(cmd.Raw()) != ping {
+			t.Fatalf("Unexpected command %d %v", i, err)
+		}
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.Int() != 12345 || string(cmd.Get(0)) != "12345" {
+		t.Fatalf("Unexpected number %v", err)
+	}
+	if cap(parser.buffer) > 4096 || parser.Position() != int64(1000*len(ping)+8) {
+		t.Errorf("Unexpected buffer %d at %d", cap(parser.buffer), parser.Position())
+	}
+	if _, err := parser.ReadCommand(); err != ErrBufferLimit {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_ProtocolVersion(t *testing.T) {
+	input := ",3.14\r\n#t\r\n_\r\n(3492890328409238509324850943850943825024385\r\n=15\r\ntxt:Some string\r\n" +
+		"!9\r\nERR oops!\r\n%2\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n#f\r\n~2\r\n+x\r\n_\r\n>2\r\n+message\r\n$2\r\nhi\r\n" +
+		"|1\r\n+ttl\r\n:5\r\n*2\r\n|1\r\n+k\r\n+v\r\n:1\r\n:2\r\n"
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeClient})
+	if _, err := parser.ReadCommand(); !errors.Is(err, ExpectTypeChar) {
+		t.Errorf("Unexpected RESP2 error %v", err)
+	}
+	if _, err := NewParser(strings.NewReader("*1\r\n#t\r\n")).ReadCommand(); !errors.Is(err, ExpectTypeChar) {
+		t.Errorf("Unexpected nested RESP2 error %v", err)
+	}
+	// the RESP3 type chars are no inline command in the other modes either
+	for _, mode := range []Mode{ModeAny, ModeServer} {
+		for _, c := range ",#_(=!%~>|" {
+			line := string(c) + "\r\n"
+			if _, err := NewParserWithOptions(strings.NewReader(line), ParserOptions{Mode: mode}).ReadCommand(); !errors.Is(err, ExpectTypeChar) {
+				t.Errorf("Unexpected RESP2 error %v for %q in mode %d", err, line, mode)
+			}
+			if _, err := NewParserWithOptions(strings.NewReader(line), ParserOptions{Mode: mode}).SkipCommand(); !errors.Is(err, ExpectTypeChar) {
+				t.Errorf("Unexpected RESP2 skip error %v for %q in mode %d", err, line, mode)
+			}
+		}
+	}
+	parser = NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeClient})
+	parser.SetProtocolVersion(3)
+	expect := []struct {
+		typ  CommandType
+		arg0 string
+		argc int
+	}{
+		{Double, "3.14", 1}, {Boolean, "t", 1}, {Null, "", 1}, {BigNumber, "3492890328409238509324850943850943825024385", 1},
+		{Verbatim, "txt:Some string", 1}, {BlobError, "ERR oops!", 1}, {Map, "a", 4}, {Set, "x", 2}, {Push, "message", 2},
+		{Attribute, "ttl", 2}, {Multi, "1", 2},
+	}
+	for i, e := range expect {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %d %v", i, err)
+		}
+		if cmd.Type() != e.typ || string(cmd.Get(0)) != e.arg0 || cmd.ArgCount() != e.argc {
+			t.Errorf("Unexpected frame %d '%c' %q %d", i, cmd.Type(), cmd.Get(0), cmd.ArgCount())
+		}
+		var b strings.Builder
+		cmd.Encode(&b)
+		if !strings.HasPrefix(input, b.String()) && i != len(expect)-1 {
+			t.Errorf("Unexpected encoding %d %q", i, b.String())
+		}
+		input = input[len(cmd.Raw()):]
+	}
+}
+
+func TestParser_RESP3Values(t *testing.T) {
+	parser := newReplyParser(strings.NewReader("#t\r\n_\r\n%1\r\n$1\r\nk\r\n,-1.5\r\n~1\r\n$1\r\na\r\n"))
+	parser.SetProtocolVersion(3)
+	cmd, _ := parser.ReadCommand()
+	if cmd.Int() != 1 {
+		t.Errorf("Unexpected boolean %d", cmd.Int())
+	}
+	if cmd, _ = parser.ReadCommand(); !cmd.IsNil() {
+		t.Errorf("Expected null")
+	}
+	var v interface{}
+	if cmd, _ = parser.ReadCommand(); cmd.Unmarshal(&v) != nil || v.(map[string]interface{})["k"] != -1.5 {
+		t.Errorf("Unexpected map %v", v)
+	}
+	var s []string
+	if cmd, _ = parser.ReadCommand(); cmd.Unmarshal(&s) != nil || len(s) != 1 || s[0] != "a" {
+		t.Errorf("Unexpected set %v", s)
+	}
+}
+
+func TestParser_BufioReader(t *testing.T) {
+	input := strings.Repeat("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 500)
+	br := bufio.NewReaderSize(iotest.HalfReader(strings.NewReader("PING\r\n"+input)), 64)
+	if line, _ := br.ReadString('\n'); line != "PING\r\n" {
+		t.Fatalf("Unexpected line %q", line)
+	}
+	parser := NewParserSize(br, 16)
+	for i := 0; i < 500; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil || cmd.ArgCount() != 2 || string(cmd.Get(1)) != "a" {
+			t.Fatalf("Unexpected command %d %v", i, err)
+		}
+	}
+	if _, err := parser.ReadCommand(); err != io.EOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_GlobalsSnapshot(t *testing.T) {
+	saved := MaxNumArg
+	defer func() { MaxNumArg = saved }()
+	parser := NewParser(&loopReader{data: []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n")})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			MaxNumArg = i % 2 // run with -race, the parser must not read the global
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if _, err := parser.ReadCommand(); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	<-done
+}
+
+func TestParser_FastPathEquivalence(t *testing.T) {
+	inputs := []string{
+		"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n",
+		"*2\r\n$3\r\nGET\r\n$-1\r\n",
+		"*2\r\n$03\r\nGET\r\n$1\r\nk\r\n",
+		"*1\r\n$3\r\nGETX\r\n",
+		"*1\r\n$4\r\nPING\n\n",
+		"*1\r\n$+4\r\nPING\r\n",
+		"*21\r\n" + strings.Repeat("$1\r\na\r\n", 21),
+		"*1\r\n$4\r\nPI",
+	}
+	for _, input := range inputs {
+		// MaxCommandBytes turns the fast path off
+		general, gerr := NewParserWithOptions(strings.NewReader(input), ParserOptions{MaxCommandBytes: 1 << 30}).ReadCommand()
+		fast, ferr := NewParser(strings.NewReader(input)).ReadCommand()
+		if (gerr == nil) != (ferr == nil) || gerr != nil && gerr.Error() != ferr.Error() {
+			t.Errorf("Unexpected errors for %q: %v %v", input, gerr, ferr)
+		} else if gerr == nil && (general.String() != fast.String() || general.Len() != fast.Len()) {
+			t.Errorf("Unexpected commands for %q: %v %v", input, general, fast)
+		}
+	}
+}
+
+func TestParser_RegisterType(t *testing.T) {
+	parser := NewParser(strings.NewReader("@$3\r\nabc\r\n*1\r\n$4\r\nPING\r\n@$1\r\nx\r\n"))
+	parser.RegisterType('@', func(p *Parser) (*Command, error) {
+		p.Skip(1)
+		reader, _, err := p.NextBulkReader()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(reader)
+		return newScalar('@', data), err
+	})
+	parser.RegisterType('*', func(p *Parser) (*Command, error) {
+		t.Errorf("Built-in types can't be overridden")
+		return nil, nil
+	})
+	for _, expect := range []string{"abc", "PING", "x"} {
+		cmd, err := parser.ReadCommand()
+		if err != nil || string(cmd.Get(0)) != expect {
+			t.Fatalf("Unexpected command %v %v", cmd, err)
+		}
+		if expect != "PING" && (cmd.Type() != '@' || cmd.Len() != len("@$3\r\nabc\r\n")-3+len(expect) || cmd.Raw() != nil && string(cmd.Raw()[:2]) != "@$") {
+			t.Errorf("Unexpected custom frame %q %d", cmd.Raw(), cmd.Len())
+		}
+	}
+	parser = NewParser(strings.NewReader("@x\r\n"))
+	parser.RegisterType('@', func(p *Parser) (*Command, error) { return nil, nil })
+	if _, err := parser.ReadCommand(); err != ExpectTypeChar {
+		t.Errorf("Unexpected error for a handler making no progress %v", err)
+	}
+	parser.RegisterType('@', nil)
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "@x" {
+		t.Errorf("Unexpected inline fallback %v %v", cmd, err)
+	}
+}
+
+func TestParser_LengthOverflow(t *testing.T) {
+	cases := map[string]error{
+		"*4294967297\r\n":                 InvalidNumArg,
+		"*1\r\n$4294967297\r\n":           InvalidBulkSize,
+		"*1\r\n*4294967297\r\n":           InvalidNumArg,
+		"*1\r\n$18446744073709551617\r\n": ExpectNumber,
+	}
+	for input, expect := range cases {
+		if _, err := NewParser(strings.NewReader(input)).ReadCommand(); !errors.Is(err, expect) {
+			t.Errorf("Unexpected error %v for %q", err, input)
+		}
+	}
+}
+
+func TestParser_SignWithoutDigits(t *testing.T) {
+	cases := map[string]error{
+		":+\r\n":       ExpectNumber,
+		":-\r\n":       ExpectNumber,
+		":\r\n":        ExpectNumber,
+		"*-\r\n":       ExpectNumber,
+		"*1\r\n$+\r\n": ExpectNumber,
+		":-":           io.ErrUnexpectedEOF,
+	}
+	for input, expect := range cases {
+		if _, err := newReplyParser(strings.NewReader(input)).ReadCommand(); !errors.Is(err, expect) {
+			t.Errorf("Unexpected error %v for %q", err, input)
+		}
+	}
+}
+
+func TestParser_Position(t *testing.T) {
+	first := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	meta := "#meta\n"
+	second := "*1\r\n$4\r\nPING\r\n"
+	reader := io.MultiReader(strings.NewReader(first), strings.NewReader(meta+second), strings.NewReader(second))
+	parser := NewParser(reader)
+	if _, err := parser.ReadCommand(); err != nil || parser.Position() != int64(len(first)) {
+		t.Fatalf("Unexpected position %d %v", parser.Position(), err)
+	}
+	if err := parser.Skip(int64(len(meta))); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for i := 1; i <= 2; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil || string(cmd.Get(0)) != "PING" {
+			t.Fatalf("Unexpected command %v", err)
+		}
+		if parser.Position() != int64(len(first)+len(meta)+i*len(second)) {
+			t.Errorf("Unexpected position %d", parser.Position())
+		}
+	}
+	if err := parser.Skip(-5); err != ErrNegativeSkip || parser.Position() != int64(len(first)+len(meta)+2*len(second)) {
+		t.Errorf("Unexpected negative skip %v at %d", err, parser.Position())
+	}
+	if err := parser.Skip(1); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_SkipUnbuffered(t *testing.T) {
+	reader := io.MultiReader(strings.NewReader("*1\r\n$4\r\nPING\r\n"), strings.NewReader("garbage*1\r\n$4\r\nECHO\r\n"))
+	parser := NewParser(reader)
+	parser.ReadCommand()
+	if err := parser.Skip(7); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(0)) != "ECHO" || parser.Position() != 35 {
+		t.Errorf("Unexpected command %v at %d", err, parser.Position())
+	}
+}
+
+func TestParser_MaxBulkSize(t *testing.T) {
+	payload := strings.Repeat("v", 1<<20)
+	input := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$" + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n"
+	cmd, err := NewParser(strings.NewReader(input)).ReadCommand()
+	if err != nil || len(cmd.Get(2)) != len(payload) {
+		t.Fatalf("Unexpected result %v", err)
+	}
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{MaxBulkSize: 1 << 16})
+	if _, err = parser.ReadCommand(); !errors.Is(err, InvalidBulkSize) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	// a limit past the int range is capped, a 4GB+1 bulk mustn't be truncated to 1 byte on 32-bit platforms
+	parser = NewParserWithOptions(strings.NewReader("*1\r\n$4294967297\r\nab\r\n"), ParserOptions{MaxBulkSize: math.MaxInt64})
+	if _, err = parser.ReadCommand(); parser.bulkSize > math.MaxInt-2 ||
+		!errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, InvalidBulkSize) {
+		t.Errorf("Unexpected error %v with limit %d", err, parser.bulkSize)
+	}
+}
+
+func TestParser_StreamedAggregate(t *testing.T) {
+	input := "*?\r\n$3\r\nSET\r\n$?\r\n;4\r\nHell\r\n;6\r\no worl\r\n;1\r\nd\r\n;0\r\n*?\r\n:1\r\n.\r\n.\r\n"
+	cmd, err := resp3(NewParser(strings.NewReader(input))).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !cmd.IsStreamed() || cmd.ArgCount() != 3 || string(cmd.Get(1)) != "Hello world" {
+		t.Fatalf("Unexpected streamed command %q", cmd.Get(1))
+	}
+	nested := cmd.Children()[2]
+	if !nested.IsStreamed() || len(nested.Children()) != 1 || nested.Children()[0].Int() != 1 {
+		t.Errorf("Unexpected nested streamed array")
+	}
+	if !cmd.IsLast() {
+		t.Errorf("Expect whole input consumed")
+	}
+}
+
+func TestParser_StreamedLimits(t *testing.T) {
+	many := strings.Repeat("$1\r\na\r\n", MaxNumArg+1)
+	chunks := ";60\r\n" + strings.Repeat("x", 60) + "\r\n;50\r\n" + strings.Repeat("x", 50) + "\r\n;0\r\n"
+	cases := map[string]error{
+		"*?\r\n" + many + ".\r\n":                    InvalidNumArg,
+		"*1\r\n*?\r\n" + many + ".\r\n":              InvalidNumArg,
+		"~?\r\n" + many + ".\r\n":                    InvalidNumArg,
+		"*1\r\n$?\r\n" + chunks:                      InvalidBulkSize,
+		"*?\r\n$1\r\na\r\n$?\r\n" + chunks + ".\r\n": InvalidBulkSize,
+	}
+	for input, expect := range cases {
+		opts := ParserOptions{MaxBulkSize: 100, Mode: ModeClient}
+		if _, err := resp3(NewParserWithOptions(strings.NewReader(input), opts)).ReadCommand(); !errors.Is(err, expect) {
+			t.Errorf("Unexpected error %v for %q", err, input)
+		}
+		if _, err := resp3(NewParserWithOptions(strings.NewReader(input), opts)).SkipCommand(); !errors.Is(err, expect) {
+			t.Errorf("Unexpected skip error %v for %q", err, input)
+		}
+	}
+	input := "*?\r\n" + strings.Repeat("$1\r\na\r\n", MaxNumArg) + ".\r\n"
+	if n, err := resp3(NewParser(strings.NewReader(input))).SkipCommand(); err != nil || n != len(input) {
+		t.Errorf("Unexpected skip %d %v", n, err)
+	}
+}
+
+func TestParser_StreamedString(t *testing.T) {
+	cmd, err := resp3(newReplyParser(strings.NewReader("$?\r\n;2\r\nab\r\n;0\r\n"))).ReadCommand()
+	if err != nil || cmd.Type() != Bulk || !cmd.IsStreamed() || string(cmd.Get(0)) != "ab" {
+		t.Errorf("Unexpected streamed string %v", err)
+	}
+	parser := NewParserWithOptions(strings.NewReader("$?\r\n;40\r\n"+strings.Repeat("a", 40)+"\r\n;0\r\n"),
+		ParserOptions{MaxBulkSize: 32, Mode: ModeClient})
+	parser.SetProtocolVersion(3)
+	if _, err = parser.ReadCommand(); !errors.Is(err, InvalidBulkSize) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	input := "*?\r\n" + strings.Repeat("$1\r\na\r\n", MaxNumArg+1) + ".\r\n"
+	if _, err = resp3(NewParser(strings.NewReader(input))).ReadCommand(); !errors.Is(err, InvalidNumArg) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	// RESP2 has no unknown lengths, a peer that didn't negotiate RESP3 can't open a streamed aggregate
+	for _, input := range []string{"*?\r\n$1\r\na\r\n.\r\n", "*1\r\n$?\r\n;1\r\na\r\n;0\r\n"} {
+		parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeServer})
+		if _, err = parser.ReadCommand(); !errors.Is(err, ExpectNumber) {
+			t.Errorf("Unexpected RESP2 error %v for %q", err, input)
+		}
+		parser = NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeServer})
+		if _, err = parser.SkipCommand(); !errors.Is(err, ExpectNumber) {
+			t.Errorf("Unexpected RESP2 skip error %v for %q", err, input)
+		}
+	}
+}
+
+func TestParser_ReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("*2\r\n$3\r\nGET\r\n"))
+	parser := NewParserWithOptions(server, ParserOptions{ReadTimeout: 50 * time.Millisecond})
+	_, err := parser.ReadCommand()
+	if !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var netErr net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expect the reader's timeout in the chain, got %v", err)
+	}
+	if _, ok := err.(*ProtocolError); ok {
+		t.Errorf("Timeout must not look like a protocol error")
+	}
+}
+
+func TestParser_ReadCommandTimeout(t *testing.T) {
+	if _, err := NewParser(strings.NewReader("PING\r\n")).ReadCommandTimeout(time.Second); err != ErrNoDeadline {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	parser := NewParser(server)
+	go client.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if cmd, err := parser.ReadCommandTimeout(time.Second); err != nil || !cmd.IsPing() {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	go client.Write([]byte("*2\r\n$3\r\nGET\r\n"))
+	start := time.Now()
+	if _, err := parser.ReadCommandTimeout(50 * time.Millisecond); !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Unexpected wait %v", elapsed)
+	}
+	// the deadline is cleared afterwards
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Write([]byte("PING\r\n"))
+	}()
+	if _, err := NewParser(server).ReadCommand(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_Stats(t *testing.T) {
+	parser := NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\nPING\r\n*x\r\n"))
+	for i := 0; i < 3; i++ {
+		parser.ReadCommand()
+	}
+	if stats := parser.Stats(); stats != (ParserStats{Commands: 2, Bytes: 21, ProtocolErrors: 1}) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	// the stream ending isn't a protocol error
+	parser = NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET"))
+	for i := 0; i < 3; i++ {
+		parser.ReadCommand()
+	}
+	if stats := parser.Stats(); stats != (ParserStats{Commands: 1, Bytes: 25}) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestParser_ExpectNumber(t *testing.T) {
+	for _, input := range []string{"*1\r\n$x\r\n", "*1\r\n:z\r\n", "*1\r\n$\r\n"} {
+		parser := NewParser(strings.NewReader(input))
+		if _, err := parser.ReadCommand(); !errors.Is(err, ExpectNumber) {
+			t.Errorf("Unexpected error %v for %q", err, input)
+		}
+		// reading on after the error is garbage but never spins on the bad byte
+		for i := 0; ; i++ {
+			if _, err := parser.ReadCommand(); err == io.EOF {
+				break
+			} else if i > len(input) {
+				t.Fatalf("No progress after error for %q", input)
+			}
+		}
+	}
+}
+
+func TestParser_MaxTotalBytes(t *testing.T) {
+	ping := "*1\r\n$4\r\nPING\r\n"
+	input := strings.Repeat(ping, 3) + "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"
+	limit := int64(3*len(ping) + 10)
+	for _, reader := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+		parser := NewParserWithOptions(reader, ParserOptions{MaxTotalBytes: limit})
+		for i := 0; i < 3; i++ {
+			if cmd, err := parser.ReadCommand(); err != nil || !cmd.IsPing() {
+				t.Fatalf("Unexpected command %v %v", cmd, err)
+			}
+		}
+		if _, err := parser.ReadCommand(); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if parser.Position() > limit {
+			t.Errorf("Read past the quota %d", parser.Position())
+		}
+	}
+}
+
+func TestParser_MaxTotalBytesStreaming(t *testing.T) {
+	input := "$20\r\n" + strings.Repeat("v", 20) + "\r\n"
+	for _, reader := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+		parser := NewParserWithOptions(reader, ParserOptions{MaxTotalBytes: 8})
+		bulk, n, err := parser.NextBulkReader()
+		if err != nil || n != 20 {
+			t.Fatalf("Unexpected bulk %d %v", n, err)
+		}
+		data, err := io.ReadAll(bulk)
+		var limit *LimitExceededError
+		if !errors.As(err, &limit) || !errors.Is(err, ErrQuotaExceeded) || limit.Limit != 8 || len(data) != 3 {
+			t.Errorf("Expect the quota to stop the bulk reader, got %d bytes %v", len(data), err)
+		}
+		if parser.Position() != 8 || parser.Stats().ProtocolErrors != 0 {
+			t.Errorf("Read past the quota %d", parser.Position())
+		}
+	}
+	for _, reader := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+		parser := NewParserWithOptions(reader, ParserOptions{MaxTotalBytes: 8})
+		if err := parser.Skip(20); !errors.Is(err, ErrQuotaExceeded) || parser.Position() != 8 {
+			t.Errorf("Expect the quota to stop Skip, got %v at %d", err, parser.Position())
+		}
+	}
+}
+
+func TestParser_NewParserWithPrefix(t *testing.T) {
+	parser := NewParserWithPrefix(strings.NewReader("ET\r\n$1\r\nk\r\n"), []byte("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nG"))
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.IsPing() {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.String() != "Multi [GET k]" {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	if _, err := parser.ReadCommand(); err != io.EOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if parser.Position() != 34 {
+		t.Errorf("Unexpected position %d", parser.Position())
+	}
+}
+
+func TestParser_LimitExceededError(t *testing.T) {
+	cases := map[string]LimitExceededError{
+		"*500\r\n":        {Kind: "args", Requested: 500, Limit: int64(MaxNumArg)},
+		"*1\r\n$1000\r\n": {Kind: "bulk", Requested: 1000, Limit: 100},
+		"*1\r\n$?\r\n;60\r\n" + strings.Repeat("x", 60) + "\r\n;50\r\n": {Kind: "bulk", Requested: 110, Limit: 100},
+		"GET" + strings.Repeat(" k", MaxNumArg) + "\r\n":                {Kind: "args", Requested: int64(MaxNumArg) + 1, Limit: int64(MaxNumArg)},
+	}
+	for input, expect := range cases {
+		_, err := resp3(NewParserWithOptions(strings.NewReader(input), ParserOptions{MaxBulkSize: 100})).ReadCommand()
+		var limit *LimitExceededError
+		if !errors.As(err, &limit) || *limit != expect {
+			t.Errorf("Unexpected error %v for %q", err, input)
+			continue
+		}
+		if expect.Kind == "args" && !errors.Is(err, ErrInvalidNumArg) || expect.Kind == "bulk" && !errors.Is(err, InvalidBulkSize) {
+			t.Errorf("Unexpected sentinel for %v", err)
+		}
+	}
+	_, err := NewParser(strings.NewReader("*500\r\n")).ReadCommand()
+	if err.Error() != "TooManyArg: requested 500 args, limit 20" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+}
+
+func TestParser_SkipComments(t *testing.T) {
+	input := "# client sends\r\n*1\r\n$4\r\nPING\r\n#reply\n# follows\r\n+PONG\r\n*1\r\n$3\r\n#ab\r\n"
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{SkipComments: true})
+	for _, expect := range []string{"Multi [PING]", "Multi [+PONG]", "Multi [#ab]"} {
+		if cmd, err := parser.ReadCommand(); err != nil || cmd.String() != expect {
+			t.Errorf("Unexpected command %v %v, expect %s", cmd, err, expect)
+		}
+	}
+	if _, err := parser.ReadCommand(); err != io.EOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+	// off by default, where '#' is a RESP3 type char, and RESP3 reads '#' as a boolean
+	if _, err := NewParser(strings.NewReader(input)).ReadCommand(); !errors.Is(err, ExpectTypeChar) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	parser = NewParserWithOptions(strings.NewReader("#t\r\n"), ParserOptions{SkipComments: true, Mode: ModeClient})
+	parser.SetProtocolVersion(3)
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.Type() != Boolean {
+		t.Errorf("Unexpected command %v %v", cmd, err)
+	}
+}
+
+func TestParser_Unread(t *testing.T) {
+	parser := NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+	ping, _ := parser.ReadCommand()
+	if err := parser.Unread(ping); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := parser.Unread(ping); err != ErrInvalidUnread {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || cmd != ping || !cmd.IsPing() {
+		t.Errorf("Unexpected command %v %v", cmd, err)
+	}
+	get, err := parser.ReadCommand()
+	if err != nil || get.String() != "Multi [GET k]" {
+		t.Fatalf("Unexpected command %v %v", get, err)
+	}
+	parser.Unread(get)
+	if cmd, _ := parser.ReadCommand(); cmd != get || parser.Stats().Commands != 2 {
+		t.Errorf("Unexpected command %v %+v", cmd, parser.Stats())
+	}
+	if _, err := parser.ReadCommand(); err != io.EOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_LockProtocol(t *testing.T) {
+	input := "PING\r\n*1\r\n$4\r\nPING\r\nPING\r\n%1\r\n+a\r\n:1\r\n"
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{LockProtocol: true, Mode: ModeServer})
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.Inline() {
+		t.Fatalf("Unexpected command before negotiation %v %v", cmd, err)
+	}
+	parser.SetProtocolVersion(3)
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.IsPing() {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	_, err := parser.ReadCommand()
+	if !errors.Is(err, ErrProtocolViolation) || err.Error() != `redisproto: protocol violation, 'P' frame after negotiating RESP3` {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// a client locked to RESP2 rejects RESP3 frames
+	parser = NewParserWithOptions(strings.NewReader("%1\r\n+a\r\n:1\r\n"), ParserOptions{LockProtocol: true, Mode: ModeClient})
+	parser.SetProtocolVersion(2)
+	if _, err := parser.ReadCommand(); !errors.Is(err, ErrProtocolViolation) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	parser = NewParserWithOptions(strings.NewReader("%1\r\n+a\r\n:1\r\n"), ParserOptions{LockProtocol: true, Mode: ModeClient})
+	parser.SetProtocolVersion(3)
+	if cmd, err := parser.ReadCommand(); err != nil || cmd.Type() != Map {
+		t.Errorf("Unexpected reply %v %v", cmd, err)
+	}
+}
+
+func TestParser_CopyOnRead(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nDEL\r\n$1\r\nb\r\n"
+	parser := NewParserWithOptions(iotest.OneByteReader(strings.NewReader(input)),
+		ParserOptions{CopyOnRead: true, PoolCommands: true})
+	first, err := parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	second, err := parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !first.EqualArgs([]byte("GET"), []byte("a")) || string(first.Raw()) != input[:20] {
+		t.Errorf("Unexpected first command %v %q", first, first.Raw())
+	}
+	if !second.EqualArgs([]byte("DEL"), []byte("b")) || first.Len() != 20 {
+		t.Errorf("Unexpected second command %v", second)
+	}
+}
+
+func TestParser_ZeroReadBufferInitSize(t *testing.T) {
+	defer func(size int) { ReadBufferInitSize = size }(ReadBufferInitSize)
+	ReadBufferInitSize = 0
+	value := strings.Repeat("v", 2000)
+	input := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2000\r\n" + value + "\r\n*1\r\n$4\r\nPING\r\n"
+	for _, parser := range []*Parser{
+		NewParser(iotest.HalfReader(strings.NewReader(input))),
+		NewParserSize(iotest.HalfReader(strings.NewReader(input)), 0),
+	} {
+		cmd, err := parser.ReadCommand()
+		if err != nil || !cmd.EqualArgs([]byte("SET"), []byte("k"), []byte(value)) {
+			t.Fatalf("Unexpected command %v", err)
+		}
+		if cap(parser.buffer) < 2000+minBufferSize {
+			t.Errorf("Expect growth with slack, got %d", cap(parser.buffer))
+		}
+		if cmd, err = parser.ReadCommand(); err != nil || !cmd.EqualArgs([]byte("PING")) {
+			t.Fatalf("Unexpected command %v", err)
+		}
+	}
+	if parser := NewParser(strings.NewReader("")); cap(parser.buffer) != minBufferSize {
+		t.Errorf("Expect the buffer to start at %d, got %d", minBufferSize, cap(parser.buffer))
+	}
+}
+
+func TestParser_CustomTypeHelpers(t *testing.T) {
+	// '@' frames carry a count of lines, e.g. "@2\r\nfoo\r\nbar\r\n"
+	input := "@2\r\nfoo\r\nbar\r\n*1\r\n$4\r\nPING\r\n@0\r\n@x\r\n@1\r\n"
+	parser := NewParser(iotest.OneByteReader(strings.NewReader(input)))
+	parser.RegisterType('@', func(p *Parser) (*Command, error) {
+		p.Skip(1)
+		n, err := p.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		cmd := NewCommand()
+		for ; n > 0; n-- {
+			line, err := p.ReadLine()
+			if err != nil {
+				return nil, err
+			}
+			cmd.AppendArg(line)
+		}
+		return cmd, nil
+	})
+	for _, expect := range [][][]byte{{[]byte("foo"), []byte("bar")}, {[]byte("PING")}, {}} {
+		cmd, err := parser.ReadCommand()
+		if err != nil || !cmd.EqualArgs(expect...) {
+			t.Fatalf("Unexpected command %v %v", cmd, err)
+		}
+	}
+	if _, err := parser.ReadCommand(); err != ExpectNumber {
+		t.Errorf("Expect ExpectNumber, got %v", err)
+	}
+	parser = NewParser(strings.NewReader("@1\r\n"))
+	parser.RegisterType('@', func(p *Parser) (*Command, error) {
+		p.Skip(1)
+		if _, err := p.ReadInt(); err != nil {
+			return nil, err
+		}
+		return nil, p.ReadNewLine()
+	})
+	if _, err := parser.ReadCommand(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expect io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestParser_LenAcrossBufferMoves(t *testing.T) {
+	defer func(size int) { ReadBufferInitSize = size }(ReadBufferInitSize)
+	ReadBufferInitSize = 1024
+	small := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	large := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$10000\r\n" + strings.Repeat("v", 10000) + "\r\n"
+	inline := "SET k " + strings.Repeat("w", 900) + "\r\n"
+	input := small + large + small + inline
+	for _, opts := range []ParserOptions{{}, {MaxBufferSize: 16 << 10}, {MaxCommandBytes: 1 << 20},
+		{MaxBufferSize: 16 << 10, MaxCommandBytes: 1 << 20}} {
+		// the small command leaves the large one starting mid buffer, reading it grows or compacts the buffer
+		parser := NewParserWithOptions(iotest.HalfReader(strings.NewReader(input)), opts)
+		for i, expect := range []string{small, large, small, inline} {
+			cmd, err := parser.ReadCommand()
+			if err != nil || cmd.Len() != len(expect) || string(cmd.Raw()) != expect {
+				t.Fatalf("Unexpected command %d with %+v: %v %d", i, opts, err, cmd.Len())
+			}
+		}
+	}
+}
+
+func TestParser_ReadFrame(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n+OK\r\n:1\r\n$3\r\nfoo\r\n>2\r\n$7\r\nmessage\r\n$1\r\nx\r\n*1\r\n+a\r\n"
+	parser := newReplyParser(strings.NewReader(input))
+	parser.SetProtocolVersion(3)
+	for i, expect := range []struct {
+		typ    CommandType
+		inline bool
+		first  string
+	}{{Multi, false, "PING"}, {Status, false, "OK"}, {Number, false, "1"}, {Bulk, false, "foo"},
+		{Push, false, "message"}, {Multi, false, "a"}} {
+		cmd, err := parser.ReadFrame()
+		if err != nil || cmd.Type() != expect.typ || cmd.Inline() != expect.inline || string(cmd.Get(0)) != expect.first {
+			t.Fatalf("Unexpected frame %d %v %v", i, cmd, err)
+		}
+	}
+	if _, err := parser.ReadFrame(); err != io.EOF {
+		t.Errorf("Expect io.EOF, got %v", err)
+	}
+}
+
+func TestParser_Resync(t *testing.T) {
+	ping := "*1\r\n$4\r\nPING\r\n"
+	cases := []struct {
+		input string
+		opts  ParserOptions
+	}{
+		{"$x\r\n" + ping, ParserOptions{Mode: ModeClient}},
+		{"*2\r\n$3\r\nGET\r\n$x\r\nfoo\r\n+OK\r\n" + ping, ParserOptions{Mode: ModeServer, DisableInline: true}},
+		{"*0\r\n" + ping, ParserOptions{Mode: ModeServer}},
+		{"GET \x00\r\nPING\r\n", ParserOptions{StrictInline: true}},
+		{"x\r\n" + ping, ParserOptions{Mode: ModeClient}},
+		{"SET k " + strings.Repeat("v", 2000) + "\r\nPING\r\n", ParserOptions{}},
+	}
+	for _, c := range cases {
+		parser := NewParserWithOptions(iotest.OneByteReader(strings.NewReader(c.input)), c.opts)
+		if _, err := parser.ReadCommand(); err == nil {
+			t.Fatalf("Expect an error for %q", c.input)
+		}
+		if err := parser.Resync(); err != nil {
+			t.Fatalf("Unexpected error resyncing %q: %v", c.input, err)
+		}
+		cmd, err := parser.ReadCommand()
+		if err != nil || !cmd.EqualArgs([]byte("PING")) || parser.Position() != int64(len(c.input)) {
+			t.Errorf("Unexpected command after resyncing %q: %v %v", c.input, cmd, err)
+		}
+	}
+	parser := NewParser(strings.NewReader("*x\r\nfoo"))
+	if _, err := parser.ReadCommand(); err == nil {
+		t.Fatalf("Expect an error")
+	}
+	if err := parser.Resync(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := parser.ReadCommand(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expect io.ErrUnexpectedEOF, got %v", err)
+	}
+	parser = NewParserWithOptions(strings.NewReader("$x\r\nfoo"), ParserOptions{DisableInline: true})
+	parser.ReadCommand()
+	if err := parser.Resync(); err != io.EOF {
+		t.Errorf("Expect io.EOF, got %v", err)
+	}
+}
+
+func TestParser_CommandsBuffered(t *testing.T) {
+	input := strings.Repeat("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 10) + "*1\r\n$4\r\nPING\r\n"
+	var cmds []*Command
+	for batch := range NewParser(iotest.HalfReader(strings.NewReader(input))).CommandsBuffered(4) {
+		if len(batch) == 0 || len(batch) > 4 {
+			t.Errorf("Unexpected batch of %d", len(batch))
+		}
+		cmds = append(cmds, batch...)
+	}
+	if len(cmds) != 11 || !cmds[0].EqualArgs([]byte("GET"), []byte("a")) || !cmds[10].EqualArgs([]byte("PING")) {
+		t.Errorf("Unexpected commands %v", cmds)
+	}
+}
+
+// chunkReader returns one chunk per Read, counting the calls.
+type chunkReader struct {
+	chunks []string
+	reads  int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	c.reads++
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; c.chunks[0] == "" {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestParser_ReadCommandNonBlocking(t *testing.T) {
+	reader := &chunkReader{chunks: []string{"*2\r\n$3\r\nGE", "", "T\r\n$1\r\na\r\n*1\r\n$4", "\r\nPING\r\n\r\n", "PI", "NG\r\n"}}
+	parser := NewParser(reader)
+	for i, expect := range []string{"", "", "GET", "PING", "", "PING"} {
+		cmd, ok, err := parser.ReadCommandNonBlocking()
+		if err != nil || ok != (expect != "") || ok && string(cmd.Get(0)) != expect || reader.reads > i+1 {
+			t.Fatalf("Unexpected result %d: %v %v %v after %d reads", i, cmd, ok, err, reader.reads)
+		}
+	}
+	if _, ok, err := parser.ReadCommandNonBlocking(); ok || err != io.EOF {
+		t.Errorf("Expect io.EOF, got %v %v", ok, err)
+	}
+	if parser.Position() != int64(len("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*1\r\n$4\r\nPING\r\n\r\nPING\r\n")) {
+		t.Errorf("Unexpected position %d", parser.Position())
+	}
+	parser = NewParser(iotest.OneByteReader(strings.NewReader("*1\r\n$4\r\nPING\r\n")))
+	for i := 0; i < 13; i++ {
+		if _, ok, err := parser.ReadCommandNonBlocking(); ok || err != nil {
+			t.Fatalf("Unexpected result at byte %d: %v %v", i, ok, err)
+		}
+	}
+	if cmd, ok, err := parser.ReadCommandNonBlocking(); !ok || err != nil || !cmd.EqualArgs([]byte("PING")) {
+		t.Errorf("Unexpected command %v %v %v", cmd, ok, err)
+	}
+	// the last chunk comes with io.EOF, the command in it is returned first
+	for _, input := range []string{"*1\r\n$4\r\nPING\r\n", "PING\r\n"} {
+		parser = NewParser(iotest.DataErrReader(strings.NewReader(input)))
+		if cmd, ok, err := parser.ReadCommandNonBlocking(); !ok || err != nil || !cmd.EqualArgs([]byte("PING")) {
+			t.Errorf("Unexpected command for %q: %v %v %v", input, cmd, ok, err)
+		}
+		if _, ok, err := parser.ReadCommandNonBlocking(); ok || err != io.EOF {
+			t.Errorf("Expect io.EOF for %q, got %v %v", input, ok, err)
+		}
+	}
+	parser = NewParser(iotest.DataErrReader(strings.NewReader("*1\r\n$4\r\nPI")))
+	if _, ok, err := parser.ReadCommandNonBlocking(); ok || err != nil {
+		t.Errorf("Expect the partial data to be kept, got %v %v", ok, err)
+	}
+	if _, ok, err := parser.ReadCommandNonBlocking(); ok || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expect io.ErrUnexpectedEOF, got %v %v", ok, err)
+	}
+}
+
+func TestParser_ValidateUTF8(t *testing.T) {
+	valid := []string{"SET clé värde 🙂\r\n", "+OK ✓\r\n", "*2\r\n-ERR ✗\r\n:1\r\n", "*1\r\n$2\r\n\xff\xfe\r\n", "$1\r\n\xff\r\n"}
+	invalid := []string{"SET k \xff\r\n", "GET \xc3\r\n", "+\xff\r\n", "*2\r\n+a\r\n-\xe2\x82\r\n"}
+	for _, input := range valid {
+		parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{ValidateUTF8: true})
+		if _, err := parser.ReadCommand(); err != nil {
+			t.Errorf("Unexpected error for %q: %v", input, err)
+		}
+	}
+	for _, input := range invalid {
+		parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{ValidateUTF8: true})
+		if _, err := parser.ReadCommand(); !errors.Is(err, ErrInvalidUTF8) || parser.Stats().ProtocolErrors != 1 {
+			t.Errorf("Expect ErrInvalidUTF8 for %q, got %v", input, err)
+		}
+		if _, err := NewParser(strings.NewReader(input)).ReadCommand(); err != nil {
+			t.Errorf("Unexpected error without the option for %q: %v", input, err)
+		}
+	}
+}
+
+func TestParser_OnFrame(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n\r\n*-1\r\n$5\r\nhello\r\n"
+	var headers []string
+	parser := NewParserWithOptions(iotest.OneByteReader(strings.NewReader(input)), ParserOptions{
+		OnFrame: func(typeChar byte, header []byte) bool {
+			headers = append(headers, string(typeChar)+string(header))
+			return typeChar == '*' && string(header) == "-1"
+		},
+	})
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.EqualArgs([]byte("PING")) {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	if _, err := parser.ReadCommand(); err != ErrStreamTransition || parser.Position() != 16 {
+		t.Fatalf("Expect ErrStreamTransition at the null array, got %v at %d", err, parser.Position())
+	}
+	if got := strings.Join(headers, "|"); got != "*1|\r|*-1" {
+		t.Errorf("Unexpected headers %q", got)
+	}
+	parser.Skip(5)
+	reader, n, err := parser.NextBulkReader()
+	if err != nil || n != 5 {
+		t.Fatalf("Unexpected bulk %d %v", n, err)
+	}
+	if data, _ := io.ReadAll(reader); string(data) != "hello" {
+		t.Errorf("Unexpected payload %q", data)
+	}
+}
+
+func TestParser_SplitCRLF(t *testing.T) {
+	// every CRLF of the command arrives split across two reads
+	reader := &chunkReader{chunks: []string{"*2\r", "\n$3\r", "\nGET\r", "\n$1\r", "\nk\r", "\n", "+OK\r", "\n"}}
+	parser := newReplyParser(reader)
+	cmd, err := parser.ReadCommand()
+	if err != nil || !cmd.EqualArgs([]byte("GET"), []byte("k")) || cmd.Len() != 20 {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	// the \n needed one more read, which mustn't have pulled in the next frame
+	if parser.Position() != 20 || parser.Buffered() != 0 || reader.reads != 6 {
+		t.Errorf("Unexpected position %d with %d buffered after %d reads", parser.Position(), parser.Buffered(), reader.reads)
+	}
+	if cmd, err = parser.ReadCommand(); err != nil || cmd.Type() != Status || string(cmd.Get(0)) != "OK" {
+		t.Errorf("Unexpected reply %v %v", cmd, err)
+	}
+	input := "*1\r\n$4\r\nPING\r\n:1\r\n"
+	parser = NewParser(iotest.OneByteReader(strings.NewReader(input)))
+	for i, pos := range []int64{14, 18} {
+		if _, err := parser.ReadCommand(); err != nil || parser.Position() != pos || parser.Buffered() != 0 {
+			t.Errorf("Unexpected frame %d %v at %d", i, err, parser.Position())
+		}
+	}
+}
+
+func TestParser_QuotedInline(t *testing.T) {
+	cases := map[string][]string{
+		`SET k "a b"` + "\r\n":              {"SET", "k", "a b"},
+		`SET k 'it\'s' "\x41\n\"\\"` + "\n": {"SET", "k", "it's", "A\n\"\\"},
+		`SET a"b c" ""` + "\r\n":            {"SET", "ab c", ""},
+		`GET 'a\nb' back\slash` + "\n":      {"GET", `a\nb`, `back\slash`},
+		`ECHO "\xzz \q"` + "\n":             {"ECHO", "xzz q"},
+	}
+	for input, expect := range cases {
+		parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{QuotedInline: true})
+		cmd, err := parser.ReadCommand()
+		if err != nil || cmd.ArgCount() != len(expect) {
+			t.Fatalf("Unexpected command for %q: %q %v", input, cmd, err)
+		}
+		for i, arg := range expect {
+			if string(cmd.Get(i)) != arg {
+				t.Errorf("Unexpected argument %d for %q: %q", i, input, cmd.Get(i))
+			}
+		}
+	}
+	for _, input := range []string{`SET k "a b` + "\n", `SET k 'a'b` + "\n", `SET "a"b` + "\n"} {
+		parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{QuotedInline: true})
+		if _, err := parser.ReadCommand(); !errors.Is(err, InvalidInline) {
+			t.Errorf("Expect InvalidInline for %q, got %v", input, err)
+		}
+	}
+	if cmd, _ := NewParser(strings.NewReader(`SET k "a b"` + "\n")).ReadCommand(); cmd.ArgCount() != 4 {
+		t.Errorf("Expect quotes to be plain bytes by default, got %q", cmd.Args())
+	}
+}
+
+// loopReader serves the same data over and over, for benchmarking the parser without running out of input.
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (l *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, l.data[l.pos:])
+	l.pos = (l.pos + n) % len(l.data)
+	return n, nil
+}
+
+func benchmarkReadCommand(b *testing.B, opts ParserOptions) {
+	benchmarkReadCommandFrom(b, &loopReader{data: []byte(strings.Repeat("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 100))}, opts)
+}
+
+func benchmarkReadCommandFrom(b *testing.B, reader io.Reader, opts ParserOptions) {
+	parser := NewParserWithOptions(reader, opts)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			b.Fatal(err)
+		}
+		cmd.Release()
+	}
+}
+
+func BenchmarkParser_ReadCommand(b *testing.B) {
+	benchmarkReadCommand(b, ParserOptions{})
+}
+
+func BenchmarkParser_ReadCommandReuseArgv(b *testing.B) {
+	benchmarkReadCommand(b, ParserOptions{ReuseArgv: true})
+}
+
+func BenchmarkParser_ReadCommandBufio(b *testing.B) {
+	reader := &loopReader{data: []byte(strings.Repeat("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 100))}
+	benchmarkReadCommandFrom(b, bufio.NewReader(reader), ParserOptions{})
+}
+
+func BenchmarkParser_ReadCommandSet(b *testing.B) {
+	benchmarkReadCommandFrom(b, &loopReader{data: []byte(strings.Repeat("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n", 1000))},
+		ParserOptions{})
+}
+
+func BenchmarkParser_ReadCommandCopyOnRead(b *testing.B) {
+	benchmarkReadCommand(b, ParserOptions{CopyOnRead: true})
+}
+
+// benchmarkBufferPeak parses a pipeline of large SETs on many parsers at once, like as many connections each
+// receiving a big value, and reports the heap in use per parser while they all hold their grown buffers.
+func benchmarkBufferPeak(b *testing.B, opts ParserOptions) {
+	const conns = 100
+	value := strings.Repeat("v", 70000)
+	input := strings.Repeat("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$70000\r\n"+value+"\r\n", 10)
+	parsers := make([]*Parser, conns)
+	var before, after runtime.MemStats
+	var peak uint64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for j := range parsers {
+			parsers[j] = NewParserWithOptions(strings.NewReader(input), opts)
+			for k := 0; k < 10; k++ {
+				if _, err := parsers[j].ReadCommand(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		runtime.ReadMemStats(&after)
+		if after.HeapInuse > before.HeapInuse+peak {
+			peak = after.HeapInuse - before.HeapInuse
+		}
+		for j := range parsers {
+			parsers[j] = nil
+		}
+	}
+	b.ReportMetric(float64(peak)/conns, "peak-heap-B/parser")
+}
+
+func BenchmarkParser_BufferPeak(b *testing.B) {
+	benchmarkBufferPeak(b, ParserOptions{})
+}
+
+func BenchmarkParser_BufferPeakMaxBufferSize(b *testing.B) {
+	benchmarkBufferPeak(b, ParserOptions{MaxBufferSize: 72 << 10})
+}
+
+// limitedLoop serves n commands of the GET benchmark input then io.EOF, so the channel producers terminate.
+func limitedLoop(n int) io.Reader {
+	get := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	return io.LimitReader(&loopReader{data: []byte(strings.Repeat(get, 100))}, int64(n*len(get)))
+}
+
+func BenchmarkParser_ReadCommandLoop(b *testing.B) {
+	parser := NewParser(limitedLoop(b.N))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParser_Commands(b *testing.B) {
+	parser := NewParser(limitedLoop(b.N))
+	b.ReportAllocs()
+	b.ResetTimer()
+	n := 0
+	for range parser.Commands() {
+		n++
+	}
+	if n != b.N {
+		b.Fatalf("Unexpected command count %d", n)
+	}
+}
+
+func BenchmarkParser_CommandsBuffered(b *testing.B) {
+	parser := NewParser(limitedLoop(b.N))
+	b.ReportAllocs()
+	b.ResetTimer()
+	n := 0
+	for cmds := range parser.CommandsBuffered(64) {
+		n += len(cmds)
+	}
+	if n != b.N {
+		b.Fatalf("Unexpected command count %d", n)
+	}
+}
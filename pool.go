@@ -0,0 +1,68 @@
+package redisproto
+
+import (
+	"io"
+	"sync"
+)
+
+var commandPool = sync.Pool{
+	New: func() interface{} {
+		return &Command{}
+	},
+}
+
+func getCommand(numArg int) *Command {
+	cmd := commandPool.Get().(*Command)
+	if cap(cmd.argv) < numArg {
+		cmd.argv = make([][]byte, 0, numArg)
+	}
+	cmd.typ = Multi
+	cmd.pooled = true
+	return cmd
+}
+
+// Release returns a command drawn from the pool (see ParserOptions.PoolCommands) for reuse. The command and
+// the argv it handed out alias pooled memory, they must not be used or retained after Release; Copy the
+// command first if it has to outlive the handler. Release is a no-op for commands not drawn from the pool.
+func (c *Command) Release() {
+	if !c.pooled {
+		return
+	}
+	argv := c.argv
+	for i := range argv {
+		argv[i] = nil
+	}
+	*c = Command{argv: argv[:0]}
+	commandPool.Put(c)
+}
+
+// ParserPool keeps parsers for reuse across connections, saving a read buffer allocation per connection for
+// servers handling many short lived ones. The zero value gives parsers like NewParser, use NewParserPool for
+// options. It's safe for concurrent use.
+type ParserPool struct {
+	opts ParserOptions
+	pool sync.Pool
+}
+
+// NewParserPool creates a pool of parsers created with NewParserWithOptions(reader, opts).
+func NewParserPool(opts ParserOptions) *ParserPool {
+	return &ParserPool{opts: opts}
+}
+
+// Get returns a parser reading from reader, a pooled one Reset onto it when available.
+func (p *ParserPool) Get(reader io.Reader) *Parser {
+	if r, ok := p.pool.Get().(*Parser); ok {
+		r.Reset(reader)
+		return r
+	}
+	return NewParserWithOptions(reader, p.opts)
+}
+
+// Put returns a parser obtained from Get to the pool once its connection is done, commands it read must no
+// longer be used. A read buffer grown by large commands is replaced with one of the initial size, so the pool
+// doesn't pin the memory of a single big value, and the reader is dropped.
+func (p *ParserPool) Put(r *Parser) {
+	r.Reset(nil)
+	r.ResetAndRelease()
+	p.pool.Put(r)
+}
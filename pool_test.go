@@ -0,0 +1,93 @@
+package redisproto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParser_PoolCommands(t *testing.T) {
+	parser := NewParserWithOptions(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*1\r\n$4\r\nPING\r\n"),
+		ParserOptions{PoolCommands: true})
+	cmd, err := parser.ReadCommand()
+	if err != nil || string(cmd.Get(1)) != "a" {
+		t.Fatalf("Unexpected command %v", err)
+	}
+	kept := cmd.Copy()
+	cmd.Release()
+	cmd, err = parser.ReadCommand()
+	if err != nil || cmd.ArgCount() != 1 || string(cmd.Get(0)) != "PING" {
+		t.Fatalf("Unexpected command %v", err)
+	}
+	cmd.Release()
+	if kept.ArgCount() != 2 || !bytes.Equal(kept.Get(0), []byte("GET")) {
+		t.Errorf("Unexpected copy of released command")
+	}
+}
+
+func BenchmarkParser_ReadCommandPooled(b *testing.B) {
+	benchmarkReadCommand(b, ParserOptions{PoolCommands: true})
+}
+
+func TestParserPool(t *testing.T) {
+	pool := NewParserPool(ParserOptions{MaxBufferSize: 1 << 20})
+	big := "*2\r\n$4\r\nECHO\r\n$100000\r\n" + strings.Repeat("v", 100000) + "\r\n"
+	parser := pool.Get(strings.NewReader(big + "*1\r\n$4\r\nPI"))
+	parser.SetProtocolVersion(3)
+	if cmd, err := parser.ReadCommand(); err != nil || len(cmd.Get(1)) != 100000 {
+		t.Fatalf("Unexpected command %v", err)
+	}
+	parser.ReadCommand() // cut short, leaves a partial command behind
+	pool.Put(parser)
+	if cap(parser.buffer) != parser.initSize || parser.reader != nil {
+		t.Errorf("Expect Put to shrink the buffer and drop the reader, got %d", cap(parser.buffer))
+	}
+	for i := 0; i < 2; i++ {
+		parser = pool.Get(strings.NewReader("*1\r\n$4\r\nPING\r\n"))
+		cmd, err := parser.ReadCommand()
+		if err != nil || !cmd.EqualArgs([]byte("PING")) || parser.Position() != 14 || parser.resp3 ||
+			parser.Stats().Commands != 1 || parser.opts.MaxBufferSize != 1<<20 {
+			t.Fatalf("Unexpected command from a pooled parser %v %v", cmd, err)
+		}
+		pool.Put(parser)
+	}
+}
+
+func BenchmarkParser_NewParserPerConn(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parser := NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\n"))
+		if _, err := parser.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParserPool(b *testing.B) {
+	var pool ParserPool
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parser := pool.Get(strings.NewReader("*1\r\n$4\r\nPING\r\n"))
+		if _, err := parser.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+		pool.Put(parser)
+	}
+}
+
+func TestParser_ReadCommandsPooled(t *testing.T) {
+	reader := &loopReader{data: []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n")}
+	pooled := NewParserWithOptions(reader, ParserOptions{PoolCommands: true})
+	plain := NewParser(reader)
+	read := func(parser *Parser) func() {
+		return func() {
+			if cmds, err := parser.ReadCommands(1); err != nil || len(cmds) != 1 || cmds[0].pooled {
+				t.Fatalf("Unexpected result %v %v", cmds, err)
+			}
+		}
+	}
+	// the pooled original goes back to the pool once copied, so reads reuse it instead of allocating
+	if allocs, limit := testing.AllocsPerRun(100, read(pooled)), testing.AllocsPerRun(100, read(plain)); allocs >= limit {
+		t.Errorf("Unexpected %v allocations per pooled read, %v without pooling", allocs, limit)
+	}
+}
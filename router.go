@@ -0,0 +1,69 @@
+package redisproto
+
+import (
+	"strings"
+)
+
+// Router dispatches commands to handlers by command name, ignoring ASCII case, e.g.
+//
+//	var router Router
+//	router.Handle("ping", func(cmd *Command, w *Writer) error { return w.WriteSimpleString("PONG") })
+//	err := router.Route(cmd, writer)
+//
+// The zero value is an empty router. Handle and Route aren't safe for concurrent use with each other, register
+// the handlers before serving.
+type Router struct {
+	// handlers grouped by name length so a lookup compares a few names only
+	routes map[int][]route
+}
+
+type route struct {
+	name string
+	fn   func(*Command, *Writer) error
+}
+
+// Handle registers fn for the commands named name, replacing the handler registered for that name before.
+func (r *Router) Handle(name string, fn func(*Command, *Writer) error) {
+	if r.routes == nil {
+		r.routes = make(map[int][]route)
+	}
+	routes := r.routes[len(name)]
+	for i := range routes {
+		if strings.EqualFold(routes[i].name, name) {
+			routes[i].fn = fn
+			return
+		}
+	}
+	r.routes[len(name)] = append(routes, route{name: name, fn: fn})
+}
+
+// Route calls the handler of cmd and returns its error. A command no handler is registered for gets the redis
+// reply "-ERR unknown command 'name', with args beginning with: ..." written to w.
+func (r *Router) Route(cmd *Command, w *Writer) error {
+	for _, route := range r.routes[len(cmd.Name())] {
+		if cmd.EqualFold(0, route.name) {
+			return route.fn(cmd, w)
+		}
+	}
+	return w.WriteError(unknownCommand(cmd))
+}
+
+// unknownCommand formats the redis error for an unknown command, quoting the name and the arguments up to 128
+// bytes. Both come from the client, CR and LF are replaced so they can't end the reply early.
+func unknownCommand(cmd *Command) string {
+	name := cmd.Name()
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	msg := append([]byte("ERR unknown command '"), name...)
+	msg = append(msg, "', with args beginning with: "...)
+	var args []byte
+	for i := 1; i < cmd.ArgCount() && len(args) < 128; i++ {
+		arg := cmd.Get(i)
+		if len(arg) > 128-len(args) {
+			arg = arg[:128-len(args)]
+		}
+		args = append(append(append(args, '\''), arg...), '\'', ' ')
+	}
+	return lineBreaks.Replace(string(append(msg, args...)))
+}
@@ -0,0 +1,65 @@
+package redisproto
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRouter_Route(t *testing.T) {
+	var router Router
+	router.Handle("ping", func(cmd *Command, w *Writer) error { return w.WriteSimpleString("PONG") })
+	router.Handle("GET", func(cmd *Command, w *Writer) error { return w.WriteBulk(cmd.Get(1)) })
+	router.Handle("Get", func(cmd *Command, w *Writer) error { return w.WriteBulk(cmd.Get(1)) })
+	router.Handle("set", func(cmd *Command, w *Writer) error { return w.WriteSimpleString("OK") })
+
+	parser := NewParser(strings.NewReader("PING\r\nget k\r\n*3\r\n$3\r\nSeT\r\n$1\r\nk\r\n$1\r\nv\r\nHGET h f\r\nfoo\r\n"))
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	for i := 0; i < 5; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if err = router.Route(cmd, w); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	expect := "+PONG\r\n$1\r\nk\r\n+OK\r\n-ERR unknown command 'HGET', with args beginning with: 'h' 'f' \r\n" +
+		"-ERR unknown command 'foo', with args beginning with: \r\n"
+	if buff.String() != expect {
+		t.Errorf("Unexpected replies %q", buff.String())
+	}
+	if len(router.routes[3]) != 2 {
+		t.Errorf("Expect GET to be registered once, got %v", router.routes[3])
+	}
+}
+
+func TestRouter_UnknownCommandInjection(t *testing.T) {
+	input := "*2\r\n$12\r\nfoo\r\n+INJECT\r\n$4\r\na\r\nb\r\n*1\r\n$200\r\n" + strings.Repeat("x", 200) + "\r\n"
+	parser := NewParser(strings.NewReader(input))
+	buff := bytes.NewBuffer(nil)
+	var router Router
+	for i := 0; i < 2; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		router.Route(cmd, NewWriter(buff))
+	}
+	expect := "-ERR unknown command 'foo  +INJECT', with args beginning with: 'a  b' \r\n" +
+		"-ERR unknown command '" + strings.Repeat("x", 128) + "', with args beginning with: \r\n"
+	if buff.String() != expect {
+		t.Errorf("Unexpected replies %q", buff.String())
+	}
+	replies := NewParserWithOptions(buff, ParserOptions{Mode: ModeClient})
+	for i := 0; i < 2; i++ {
+		if cmd, err := replies.ReadCommand(); err != nil || cmd.Type() != Error {
+			t.Fatalf("Unexpected reply %v %v", cmd, err)
+		}
+	}
+	if _, err := replies.ReadCommand(); err != io.EOF {
+		t.Errorf("Expect no injected reply, got %v", err)
+	}
+}
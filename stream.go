@@ -0,0 +1,379 @@
+package redisproto
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+type bulkReader struct {
+	parser *Parser
+	remain int64
+	done   bool
+}
+
+func (b *bulkReader) Read(p []byte) (int, error) {
+	r := b.parser
+	if b.remain == 0 {
+		if !b.done {
+			b.done = true
+			if e := r.discardNewLine(); e != nil {
+				return 0, e
+			}
+			if r.parsePosition >= r.writeIndex {
+				r.reset()
+			}
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remain {
+		p = p[:b.remain]
+	}
+	var n int
+	var err error
+	if r.parsePosition < r.writeIndex {
+		n = copy(p, r.buffer[r.parsePosition:r.writeIndex])
+		r.parsePosition += n
+	} else {
+		// nothing buffered, read straight from the source
+		r.reset()
+		n, err = r.readDirect(p)
+		r.base += int64(n)
+	}
+	b.remain -= int64(n)
+	if err == io.EOF && b.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// NextBulkReader reads the header of the next frame which must be a bulk string and returns a reader streaming
+// exactly length bytes of its data, the trailing CRLF is consumed when the reader reaches EOF. Unlike ReadCommand
+// the bulk size isn't limited by MaxBulkSize so it's suitable for copying a huge payload to disk or downstream.
+// A null bulk returns a nil reader and length -1. The reader must be drained before the next call on the parser.
+func (r *Parser) NextBulkReader() (io.Reader, int64, error) {
+	if e := r.requireNBytes(1); e != nil {
+		return nil, 0, e
+	}
+	if r.buffer[r.parsePosition] != '$' {
+		return nil, 0, ExpectTypeChar
+	}
+	r.parsePosition++
+	plen, e := r.readNumber()
+	if e != nil {
+		return nil, 0, e
+	}
+	if e = r.discardNewLine(); e != nil {
+		return nil, 0, e
+	}
+	if r.pending > 0 {
+		r.pending--
+	}
+	switch {
+	case plen == -1:
+		if r.parsePosition >= r.writeIndex {
+			r.reset()
+		}
+		return nil, -1, nil
+	case plen < -1:
+		return nil, 0, InvalidBulkSize
+	}
+	r.bulk = &bulkReader{parser: r, remain: plen}
+	return r.bulk, plen, nil
+}
+
+// drain discards what's left of the bulk data and its CRLF.
+func (b *bulkReader) drain() error {
+	if b.remain > 0 {
+		if e := b.parser.Skip(b.remain); e != nil {
+			return e
+		}
+		b.remain = 0
+	}
+	if _, e := b.Read(nil); e != io.EOF {
+		return e
+	}
+	return nil
+}
+
+// Drain discards the rest of a command whose head was read by ReadHeader: what's left of the current bulk
+// reader and the arguments not read yet, skipped without buffering their data. The parser is then at the next
+// frame, e.g. after rejecting a command by its name. It's a no-op when nothing is pending.
+func (r *Parser) Drain() error {
+	if b := r.bulk; b != nil {
+		r.bulk = nil
+		if e := b.drain(); e != nil {
+			return e
+		}
+	}
+	for r.pending > 0 {
+		if _, length, e := r.NextBulkReader(); e != nil {
+			return e
+		} else if length < 0 {
+			continue
+		}
+		b := r.bulk
+		r.bulk = nil
+		if e := b.drain(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// ReadHeader reads only the head of the next multi-bulk command, "*<argc>\r\n" and the command name, so a
+// proxy can route the command before its arguments are buffered. The argc-1 remaining arguments are left
+// unread, they must be consumed with NextBulkReader (or Skip) before the next ReadCommand or ReadHeader,
+// otherwise the parser is out of sync with the stream. An empty or null array returns a nil name and argc 0,
+// unless empty commands are rejected (see ParserOptions.RejectEmptyCommands). Blank inline lines ahead of the
+// command are skipped like ReadCommand does.
+// The name points into the read buffer and is only valid until the next call on the parser.
+func (r *Parser) ReadHeader() (name []byte, argc int, err error) {
+	if e := r.skipBlankLines(); e != nil {
+		return nil, 0, e
+	}
+	r.cmdBegin = r.parsePosition
+	r.pending, r.bulk = 0, nil
+	if r.buffer[r.parsePosition] != '*' {
+		return nil, 0, ExpectTypeChar
+	}
+	r.parsePosition++
+	numArg, e := r.readNumber()
+	if e != nil {
+		return nil, 0, e
+	}
+	if e = r.discardNewLine(); e != nil {
+		return nil, 0, e
+	}
+	switch {
+	case numArg < -1:
+		return nil, 0, InvalidNumArg
+	case numArg > int64(r.maxNumArg()):
+		return nil, 0, r.tooManyArgs(numArg)
+	case numArg <= 0 && r.rejectEmpty():
+		return nil, 0, emptyCommand(numArg)
+	case numArg > 0:
+		if name, e = r.parseString(); e != nil {
+			return nil, 0, e
+		}
+		argc = int(numArg)
+		r.pending = argc - 1
+	}
+	if r.parsePosition >= r.writeIndex {
+		r.reset()
+	}
+	return name, argc, nil
+}
+
+// SkipCommand discards the next command and returns the number of bytes it took on the stream, for tools that
+// only look at some commands, e.g. sampling one in a hundred. Arrays of bulk strings and inline commands are
+// walked without building a Command, bulk data is stepped over rather than buffered so a large value costs no
+// memory either. Blank inline lines are skipped on the way like ReadCommand does, and its limits and
+// ParserOptions.OnFrame apply except MaxCommandBytes. Other frames (replies, custom types, inline input with
+// LenientNewline) are parsed with ReadCommand and dropped. Like ReadCommand it returns io.EOF only at a command
+// boundary.
+func (r *Parser) SkipCommand() (int, error) {
+	if cmd := r.unread; cmd != nil {
+		r.unread = nil
+		return cmd.Len(), nil
+	}
+	start := r.Position()
+	err := r.skipCommand()
+	if r.parsePosition >= r.writeIndex {
+		r.reset()
+	}
+	return int(r.Position() - start), err
+}
+
+func (r *Parser) skipCommand() error {
+	r.partial = nil
+	r.pending, r.bulk = 0, nil
+	r.dataToken = false
+	for {
+		if e := r.requireNBytes(1); e != nil {
+			return e
+		}
+		r.cmdBegin = r.parsePosition
+		c := r.buffer[r.parsePosition]
+		if c == '*' || r.plainInline(c) {
+			if err := r.frameHook(); err != nil {
+				return err
+			}
+		}
+		if c == '*' {
+			err := r.skipAggregate(0)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		} else if !r.plainInline(c) {
+			_, err := r.readCommand()
+			return err
+		}
+		if blank, err := r.skipInline(); err != nil || !blank || r.opts.KeepBlankInline {
+			return err
+		}
+	}
+}
+
+// plainInline tells whether a frame starting with c is an inline command skipInline can discard as is.
+func (r *Parser) plainInline(c byte) bool {
+	if c == '$' || c == ':' || c == '+' || c == '-' || resp3Type(c) {
+		return false
+	}
+	return r.types[c] == nil && !r.skipLF && !r.opts.LenientNewline && !r.opts.DisableInline &&
+		r.opts.Mode != ModeClient && !(r.opts.LockProtocol && r.versionSet)
+}
+
+// skipBlankLines discards the blank inline lines ahead of the next frame that ReadCommand would skip, leaving
+// the frame itself unread.
+func (r *Parser) skipBlankLines() error {
+	for {
+		if e := r.requireNBytes(1); e != nil {
+			return e
+		}
+		if r.opts.KeepBlankInline || !r.plainInline(r.buffer[r.parsePosition]) {
+			return nil
+		}
+		for off := 0; ; off++ {
+			if e := r.requireNBytes(off + 1); e != nil {
+				if e == io.EOF {
+					e = io.ErrUnexpectedEOF
+				}
+				return e
+			}
+			if c := r.buffer[r.parsePosition+off]; c == '\n' {
+				if r.parsePosition += off + 1; r.parsePosition >= r.writeIndex {
+					r.reset()
+				}
+				break
+			} else if c != ' ' && c != '\t' && c != '\r' {
+				return nil // not blank, the frame starts here
+			}
+			if off >= r.telnetLine {
+				return LineTooLong
+			}
+		}
+	}
+}
+
+// skipInline discards an inline line and tells whether it was blank.
+func (r *Parser) skipInline() (bool, error) {
+	for {
+		line := r.buffer[r.parsePosition:r.writeIndex]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			r.parsePosition += i + 1
+			return len(bytes.Trim(line[:i], " \t\r")) == 0, nil
+		}
+		if len(line) > r.telnetLine {
+			return false, LineTooLong
+		}
+		if e := r.readSome(1); e != nil {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			return false, e
+		}
+	}
+}
+
+// skipAggregate discards an array, or a RESP3 aggregate nested in one, starting at its type char.
+func (r *Parser) skipAggregate(depth int) error {
+	typ := r.buffer[r.parsePosition]
+	r.parsePosition++
+	n, streamed, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	if depth == 0 && !streamed && n <= 0 && n >= -1 && r.rejectEmpty() {
+		return emptyCommand(n)
+	}
+	switch {
+	case streamed || n == -1:
+		n = 0
+	case n < -1:
+		return InvalidNumArg
+	case typ == '%' || typ == '|':
+		n *= 2
+	}
+	if n > int64(r.maxNumArg()) {
+		return r.tooManyArgs(n)
+	}
+	for i := int64(0); streamed || i < n; i++ {
+		if e := r.requireNBytes(1); e != nil {
+			return e
+		}
+		c := r.buffer[r.parsePosition]
+		if streamed && c != '.' && i >= int64(r.maxNumArg()) {
+			// like parseElements, the elements of a streamed aggregate add up to the same limit
+			return r.tooManyArgs(i + 1)
+		}
+		if depth == 0 && r.opts.Mode == ModeServer && c != '$' && !(c == '.' && streamed) {
+			// like parseElements, commands sent by clients are arrays of bulk strings only
+			return elementError(int(i), &ProtocolError{message: fmt.Sprintf("expect '$', got %q", c), cause: ExpectTypeChar})
+		}
+		switch {
+		case c == '.' && streamed:
+			r.parsePosition++
+			return r.discardNewLine()
+		case c == '$':
+			err = r.skipBulk(depth)
+		case c == '*' || r.resp3 && resp3Aggregate(c):
+			if depth >= r.nesting {
+				return InvalidNesting
+			}
+			err = r.skipAggregate(depth + 1)
+			if c == '|' {
+				i-- // like parseRESP3Element, an attribute annotates the next element and isn't one itself
+			}
+		default:
+			_, _, err = r.parseElement(depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipBulk discards a bulk string starting at its '$', its data is dropped as it's read.
+func (r *Parser) skipBulk(depth int) error {
+	if e := r.requireNBytes(2); e != nil {
+		return e
+	}
+	if r.buffer[r.parsePosition+1] == '?' {
+		_, _, err := r.parseElement(depth) // streamed string, chunked
+		return err
+	}
+	r.parsePosition++
+	n, err := r.readNumber()
+	if err != nil {
+		return err
+	}
+	if err = r.discardNewLine(); err != nil {
+		return err
+	}
+	switch {
+	case n == -1:
+		return nil
+	case n < -1:
+		return InvalidBulkSize
+	case n > r.maxBulkSize():
+		return r.bulkTooLarge(n)
+	}
+	for n > 0 {
+		if r.parsePosition >= r.writeIndex {
+			r.reset()
+			if e := r.readSome(1); e != nil {
+				return e
+			}
+		}
+		step := r.writeIndex - r.parsePosition
+		if int64(step) > n {
+			step = int(n)
+		}
+		r.parsePosition += step
+		n -= int64(step)
+	}
+	return r.discardNewLine()
+}
@@ -0,0 +1,218 @@
+package redisproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParser_NextBulkReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1<<14)
+	input := "$" + strconv.Itoa(len(payload)) + "\r\n" + string(payload) + "\r\n*1\r\n$4\r\nPING\r\n"
+	parser := NewParser(iotest.HalfReader(strings.NewReader(input)))
+	reader, length, err := parser.NextBulkReader()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if length != int64(len(payload)) {
+		t.Fatalf("Unexpected length %d", length)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("Unexpected payload of %d bytes", len(data))
+	}
+	cmd, err := parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected command after bulk %q", cmd.Get(0))
+	}
+}
+
+func TestParser_NextBulkReaderTruncated(t *testing.T) {
+	parser := NewParser(strings.NewReader("$10\r\nabc"))
+	reader, _, err := parser.NextBulkReader()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err = io.ReadAll(reader); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_NextBulkReaderNull(t *testing.T) {
+	reader, length, err := NewParser(strings.NewReader("$-1\r\n")).NextBulkReader()
+	if err != nil || reader != nil || length != -1 {
+		t.Errorf("Unexpected result %v %d %v", reader, length, err)
+	}
+}
+
+func TestParser_ReadHeader(t *testing.T) {
+	payload := strings.Repeat("v", 100000)
+	input := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$" + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n*0\r\n*1\r\n$4\r\nPING\r\n"
+	parser := NewParserSize(iotest.HalfReader(strings.NewReader(input)), 64)
+	name, argc, err := parser.ReadHeader()
+	if err != nil || string(name) != "SET" || argc != 3 {
+		t.Fatalf("Unexpected header %q %d %v", name, argc, err)
+	}
+	var rest []string
+	for i := 1; i < argc; i++ {
+		reader, _, err := parser.NextBulkReader()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		rest = append(rest, string(data))
+	}
+	if len(rest) != 2 || rest[0] != "k" || rest[1] != payload || cap(parser.buffer) > 1024 {
+		t.Errorf("Unexpected arguments of %d bytes, buffer %d", len(rest[1]), cap(parser.buffer))
+	}
+	if name, argc, err = parser.ReadHeader(); err != nil || name != nil || argc != 0 {
+		t.Errorf("Unexpected empty header %q %d %v", name, argc, err)
+	}
+	cmd, err := parser.ReadCommand()
+	if err != nil || string(cmd.Get(0)) != "PING" {
+		t.Errorf("Unexpected command after header %v", err)
+	}
+	// blank inline lines are skipped like ReadCommand does
+	parser = NewParser(iotest.OneByteReader(strings.NewReader("\r\n \r\n\n*1\r\n$4\r\nPING\r\n\r\n")))
+	if name, argc, err = parser.ReadHeader(); err != nil || string(name) != "PING" || argc != 1 || parser.Position() != 20 {
+		t.Errorf("Unexpected header after blank lines %q %d %v at %d", name, argc, err, parser.Position())
+	}
+	if _, _, err = parser.ReadHeader(); err != io.EOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, _, err = NewParser(strings.NewReader("\r\nGET k\r\n")).ReadHeader(); err != ExpectTypeChar {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParser_Drain(t *testing.T) {
+	payload := strings.Repeat("v", 100000)
+	input := "*4\r\n$3\r\nSET\r\n$1\r\nk\r\n$-1\r\n$" + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n*1\r\n$4\r\nPING\r\n"
+	for _, partial := range []bool{false, true} {
+		parser := NewParserSize(iotest.HalfReader(strings.NewReader(input)), 64)
+		if _, _, err := parser.ReadHeader(); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if partial {
+			reader, _, _ := parser.NextBulkReader()
+			io.ReadAll(reader)
+			parser.NextBulkReader()
+			reader, _, _ = parser.NextBulkReader()
+			if _, err := io.ReadFull(reader, make([]byte, 10)); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+		}
+		if err := parser.Drain(); err != nil {
+			t.Fatalf("Unexpected drain error %v", err)
+		}
+		cmd, err := parser.ReadCommand()
+		if err != nil || string(cmd.Get(0)) != "PING" || cap(parser.buffer) > 1024 {
+			t.Errorf("Unexpected command after drain %v %d", err, cap(parser.buffer))
+		}
+		if err = parser.Drain(); err != nil {
+			t.Errorf("Unexpected error draining nothing %v", err)
+		}
+	}
+}
+
+func TestParser_SkipCommand(t *testing.T) {
+	payload := strings.Repeat("v", 100000)
+	first := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$100000\r\n" + payload + "\r\n"
+	second := "\r\n  \r\nMSET a  b\r\n"
+	third := "*2\r\n*1\r\n:1\r\n$-1\r\n"
+	input := first + second + third + "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"
+	parser := NewParserSize(iotest.HalfReader(strings.NewReader(input)), 64)
+	for _, expect := range []string{first, second, third} {
+		if n, err := parser.SkipCommand(); err != nil || n != len(expect) {
+			t.Fatalf("Unexpected skip of %d bytes, expect %d: %v", n, len(expect), err)
+		}
+	}
+	if cap(parser.buffer) > 1024 {
+		t.Errorf("Expect the skipped payload not to be buffered, buffer is %d", cap(parser.buffer))
+	}
+	cmd, err := parser.ReadCommand()
+	if err != nil || !cmd.EqualArgs([]byte("GET"), []byte("k")) {
+		t.Fatalf("Unexpected command after skipping %v %v", cmd, err)
+	}
+	if n, err := parser.SkipCommand(); n != 0 || err != io.EOF {
+		t.Errorf("Expect io.EOF, got %d %v", n, err)
+	}
+	for input, expect := range map[string]error{
+		"*2\r\n$3\r\nGET\r\n$1\r\nk": io.ErrUnexpectedEOF,
+		"*1\r\n$x\r\n":               ExpectNumber,
+		"*1\r\n$1\r\nab\r\n":         ExpectNewLine,
+		"GET k":                      io.ErrUnexpectedEOF,
+		"+OK\r\n":                    nil,
+	} {
+		if _, err := NewParser(strings.NewReader(input)).SkipCommand(); err != expect {
+			t.Errorf("Unexpected error skipping %q: %v", input, err)
+		}
+	}
+}
+
+func TestParser_SkipCommandOnFrame(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n\r\nPING\r\n*-1\r\n$5\r\nhello\r\n"
+	frames := 0
+	parser := NewParserWithOptions(strings.NewReader(input), ParserOptions{
+		OnFrame: func(typeChar byte, header []byte) bool {
+			frames++
+			return typeChar == '*' && string(header) == "-1"
+		},
+	})
+	for _, expect := range []int{14, 8} {
+		if n, err := parser.SkipCommand(); err != nil || n != expect {
+			t.Fatalf("Unexpected skip of %d bytes %v, expect %d", n, err, expect)
+		}
+	}
+	if n, err := parser.SkipCommand(); n != 0 || err != ErrStreamTransition || frames != 4 {
+		t.Errorf("Expect ErrStreamTransition at the null array, got %d %v after %d frames", n, err, frames)
+	}
+}
+
+func TestParser_SkipCommandModeServer(t *testing.T) {
+	for _, input := range []string{"*2\r\n:1\r\n:2\r\n", "*2\r\n$3\r\nGET\r\n*1\r\n$1\r\nk\r\n"} {
+		_, readErr := NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeServer}).ReadCommand()
+		_, skipErr := NewParserWithOptions(strings.NewReader(input), ParserOptions{Mode: ModeServer}).SkipCommand()
+		if !errors.Is(skipErr, ExpectTypeChar) || readErr == nil || skipErr.Error() != readErr.Error() {
+			t.Errorf("Expect SkipCommand to fail like ReadCommand for %q: %v %v", input, skipErr, readErr)
+		}
+	}
+	if n, err := NewParser(strings.NewReader("*2\r\n:1\r\n:2\r\n")).SkipCommand(); n != 12 || err != nil {
+		t.Errorf("Unexpected skip in ModeAny %d %v", n, err)
+	}
+}
+
+func TestParser_SkipCommandAttribute(t *testing.T) {
+	input := "*2\r\n|1\r\n+ttl\r\n:5\r\n:1\r\n:2\r\n*?\r\n|1\r\n+k\r\n+v\r\n:2\r\n.\r\n*1\r\n$4\r\nPING\r\n"
+	parser := newReplyParser(strings.NewReader(input))
+	parser.SetProtocolVersion(3)
+	for _, expect := range []int{26, 23} {
+		if n, err := parser.SkipCommand(); err != nil || n != expect {
+			t.Fatalf("Unexpected skip %d %v, expect %d", n, err, expect)
+		}
+	}
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.EqualArgs([]byte("PING")) {
+		t.Errorf("Unexpected command after skipping %v %v", cmd, err)
+	}
+}
+
+func BenchmarkParser_SkipCommand(b *testing.B) {
+	parser := NewParser(&loopReader{data: []byte(strings.Repeat("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 100))})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.SkipCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package redisproto
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// NextToken returns the next frame on the wire as it is, for protocol analyzers that need to see malformed
+// input too rather than parsed commands. typeChar is the type char of the frame and payload the rest of its
+// line without the CRLF, e.g. '*' and "3" for an array header. The data following a bulk header ('$', '=',
+// '!' and the ';' chunks of a streamed string) is a token of its own with typeChar 0, and so is a line not
+// starting with a type char, like an inline command. A bulk whose data isn't followed by CRLF returns its data
+// along with ExpectNewLine, the next token starts right after the data.
+// It doesn't enforce the grouping ReadCommand does: nothing checks an array gets the elements it declares or that
+// lengths are numbers, so it can be mixed with ReadCommand only at frame boundaries. The payload points into the
+// read buffer and is valid until the next read, like Command arguments.
+func (r *Parser) NextToken() (typeChar byte, payload []byte, err error) {
+	data := r.dataToken
+	r.cmdBegin = r.parsePosition
+	typeChar, payload, err = r.nextToken()
+	if err == io.EOF && (data || r.writeIndex > r.parsePosition) {
+		err = io.ErrUnexpectedEOF
+	}
+	if (err == nil || err == ExpectNewLine) && r.parsePosition >= r.writeIndex {
+		r.reset()
+	}
+	return typeChar, payload, err
+}
+
+func (r *Parser) nextToken() (byte, []byte, error) {
+	if r.dataToken {
+		r.dataToken = false
+		if e := r.requireNBytes(r.tokenLen); e != nil {
+			return 0, nil, e
+		}
+		data := r.buffer[r.parsePosition : r.parsePosition+r.tokenLen]
+		r.parsePosition += r.tokenLen
+		// on a missing CRLF the data is still whole, the bytes in its place start the next token
+		return 0, data, r.discardNewLine()
+	}
+	line, e := r.readTokenLine()
+	if e != nil {
+		return 0, nil, e
+	}
+	if len(line) == 0 {
+		return 0, line, nil
+	}
+	switch typeChar := line[0]; typeChar {
+	case '$', '=', '!', ';':
+		n, e := strconv.ParseInt(string(line[1:]), 10, 64)
+		if e == nil && n > r.maxBulkSize() {
+			return typeChar, line[1:], r.bulkTooLarge(n)
+		}
+		if e == nil && n >= 0 && (typeChar != ';' || n > 0) {
+			r.dataToken, r.tokenLen = true, int(n)
+		}
+		return typeChar, line[1:], nil
+	case '*', ':', '+', '-', ',', '#', '_', '(', '%', '~', '>', '|', '.':
+		return typeChar, line[1:], nil
+	}
+	return 0, line, nil
+}
+
+// readTokenLine reads a line ending with \n, with the \n and a \r before it stripped. Unlike readLine it
+// accepts a bare \n so an analyzer sees exactly where each line ends.
+func (r *Parser) readTokenLine() ([]byte, error) {
+	for {
+		if i := bytes.IndexByte(r.buffer[r.parsePosition:r.writeIndex], '\n'); i >= 0 {
+			line := r.buffer[r.parsePosition : r.parsePosition+i]
+			r.parsePosition += i + 1
+			return bytes.TrimSuffix(line, []byte{'\r'}), nil
+		}
+		if r.writeIndex-r.parsePosition > r.lineSize {
+			return nil, LineTooLong
+		}
+		if e := r.readSome(1); e != nil {
+			return nil, e
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package redisproto
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParser_NextToken(t *testing.T) {
+	data := "*2\r\n$3\r\nGET\r\n$abc\r\n:1\n$2\r\nxyz\r\nPING\r\n\r\n$0\r\n\r\n"
+	expect := []struct {
+		typ     byte
+		payload string
+		err     error
+	}{
+		{'*', "2", nil}, {'$', "3", nil}, {0, "GET", nil}, {'$', "abc", nil}, {':', "1", nil}, {'$', "2", nil},
+		{0, "xy", ExpectNewLine}, {0, "z", nil}, {0, "PING", nil}, {0, "", nil}, {'$', "0", nil}, {0, "", nil},
+		{0, "", io.EOF},
+	}
+	for _, reader := range []io.Reader{strings.NewReader(data), iotest.OneByteReader(strings.NewReader(data))} {
+		parser := NewParser(reader)
+		for i, e := range expect {
+			typ, payload, err := parser.NextToken()
+			if typ != e.typ || string(payload) != e.payload || err != e.err {
+				t.Fatalf("Unexpected token %d %q %q %v", i, typ, payload, err)
+			}
+		}
+	}
+}
+
+func TestParser_NextTokenMixed(t *testing.T) {
+	parser := NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPI"))
+	if cmd, err := parser.ReadCommand(); err != nil || !cmd.IsPing() {
+		t.Fatalf("Unexpected command %v %v", cmd, err)
+	}
+	parser.NextToken()
+	parser.NextToken()
+	if _, payload, err := parser.NextToken(); err != io.ErrUnexpectedEOF || payload != nil {
+		t.Errorf("Unexpected data token %q %v", payload, err)
+	}
+}
@@ -2,9 +2,14 @@ package redisproto
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -13,13 +18,31 @@ var (
 	dollar = []byte{'$'}
 	plus   = []byte{'+'}
 	subs   = []byte{'-'}
+	tilde  = []byte{'~'}
 	// newLine  = []byte{'\r', '\n'}
 	// nilBulk  = []byte{'$', '-', '1', '\r', '\n'}
 	// nilArray = []byte{'*', '-', '1', '\r', '\n'}
 )
 
+var (
+	// ErrNeedRESP3 is returned when writing a RESP3 only frame on a writer that hasn't been switched to RESP3.
+	ErrNeedRESP3 = errors.New("redisproto: frame requires RESP3")
+	// ErrVerbatimFormat is returned by WriteVerbatim when the format isn't 3 characters like "txt" or "mkd".
+	ErrVerbatimFormat = errors.New("redisproto: verbatim format must be 3 characters")
+	// ErrInlineNewline is returned by WriteInline for an argument containing a CR or LF.
+	ErrInlineNewline = errors.New("redisproto: inline argument contains a newline")
+)
+
+var nullFrame = []byte{'_', '\r', '\n'}
+
+// lineBreaks replaces the bytes ending a line, which can't appear in a simple string or error reply.
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
 type Writer struct {
-	w io.Writer
+	w              io.Writer
+	flushThreshold int
+	resp3          bool
+	scratch        [32]byte // formats small frames without allocating
 }
 
 func NewWriter(sink io.Writer) *Writer {
@@ -39,6 +62,33 @@ func (w *Writer) Flush() error {
 	return nil
 }
 
+// Buffered returns the number of bytes written but not flushed yet, it's always 0 unless the sink is a *bufio.Writer.
+func (w *Writer) Buffered() int {
+	if f, ok := w.w.(*bufio.Writer); ok {
+		return f.Buffered()
+	}
+	return 0
+}
+
+// SetFlushThreshold makes WriteAndMaybeFlush flush as soon as buffered output reaches n bytes, even if the
+// command isn't the last one of a pipeline. Zero (the default) disables the threshold.
+func (w *Writer) SetFlushThreshold(n int) {
+	w.flushThreshold = n
+}
+
+// WriteAndMaybeFlush calls fn to write the response of cmd, then flushes if cmd is the last command in the
+// receive buffer or the buffered output exceeds the flush threshold. It's the recommended way to answer
+// pipelined commands.
+func (w *Writer) WriteAndMaybeFlush(cmd *Command, fn func(*Writer) error) error {
+	if err := fn(w); err != nil {
+		return err
+	}
+	if cmd.IsLast() || (w.flushThreshold > 0 && w.Buffered() >= w.flushThreshold) {
+		return w.Flush()
+	}
+	return nil
+}
+
 func (w *Writer) WriteInt(val int64) error {
 	w.Write(colon)
 	w.Write(strconv.AppendInt(nil,val,10))
@@ -59,6 +109,91 @@ func (w *Writer) WriteBulk(val []byte) error {
 	return err
 }
 
+// WriteBulkInt writes n as a bulk string of its decimal digits, like WriteBulkString(strconv.FormatInt(n, 10))
+// without formatting it into a string first.
+func (w *Writer) WriteBulkInt(n int64) error {
+	var digits [20]byte
+	num := strconv.AppendInt(digits[:0], n, 10)
+	dst := append(w.scratch[:0], '$')
+	dst = strconv.AppendInt(dst, int64(len(num)), 10)
+	dst = append(append(append(dst, newLine...), num...), newLine...)
+	_, err := w.Write(dst)
+	return err
+}
+
+// WriteInline writes args as an inline command, space separated and CRLF terminated like a user typing in
+// telnet, for tests and debugging tools. An argument that's empty or holds spaces, quotes or control bytes is
+// double quoted with escapes, so a parser with ParserOptions.QuotedInline reads the same arguments back. A CR or
+// LF can't be sent inline, an argument containing one fails with ErrInlineNewline and nothing is written.
+func (w *Writer) WriteInline(args ...[]byte) error {
+	n := 2
+	for _, arg := range args {
+		if bytes.IndexAny(arg, "\r\n") >= 0 {
+			return ErrInlineNewline
+		}
+		n += len(arg) + 3
+	}
+	line := make([]byte, 0, n)
+	for i, arg := range args {
+		if i > 0 {
+			line = append(line, ' ')
+		}
+		line = appendInlineArg(line, arg)
+	}
+	_, err := w.Write(append(line, newLine...))
+	return err
+}
+
+// appendInlineArg appends arg to an inline line, quoted when the inline tokenizer would split or unquote it.
+func appendInlineArg(dst, arg []byte) []byte {
+	quote := len(arg) == 0
+	for _, c := range arg {
+		if c <= ' ' || c == 0x7f || c == '"' || c == '\'' {
+			quote = true
+			break
+		}
+	}
+	if !quote {
+		return append(dst, arg...)
+	}
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for _, c := range arg {
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c < ' ' || c == 0x7f:
+			dst = append(dst, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"')
+}
+
+// WriteIntArray writes vals as an array of integers, a nil slice as a null array.
+func (w *Writer) WriteIntArray(vals []int64) error {
+	if vals == nil {
+		_, err := w.Write(nilArray)
+		return err
+	}
+	if err := w.writeInt('*', int64(len(vals))); err != nil {
+		return err
+	}
+	for _, v := range vals {
+		if err := w.writeInt(':', v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeInt(typ byte, n int64) error {
+	dst := strconv.AppendInt(append(w.scratch[:0], typ), n, 10)
+	_, err := w.Write(append(dst, newLine...))
+	return err
+}
+
 func (w *Writer) WriteBulkString(s string) error {
 	return w.WriteBulk([]byte(s))
 }
@@ -77,6 +212,130 @@ func (w *Writer) WriteError(s string) error {
 	return err
 }
 
+// WriteErrorf writes an error reply formatted with fmt.Sprintf, e.g. WriteErrorf("ERR unknown command '%s'", name).
+// A CR or LF in the message, e.g. from a client supplied argument, would end the reply early and inject what
+// follows as another one, so each is replaced with a space like redis does rather than failing the reply.
+func (w *Writer) WriteErrorf(format string, args ...interface{}) error {
+	return w.WriteError(lineBreaks.Replace(fmt.Sprintf(format, args...)))
+}
+
+// WriteErrorCode writes an error reply prefixed by an error code, e.g. WriteErrorCode("WRONGTYPE", msg)
+// emits "-WRONGTYPE msg". Redis uses "ERR" as the generic code. Like WriteErrorf it replaces a CR or LF in
+// either one with a space, so the reply can't be split.
+func (w *Writer) WriteErrorCode(code, msg string) error {
+	w.Write(subs)
+	w.Write([]byte(lineBreaks.Replace(code)))
+	w.Write(spaceSlice)
+	w.Write([]byte(lineBreaks.Replace(msg)))
+	_, err := w.Write(newLine)
+	return err
+}
+
+// WriteNullBulk writes a null bulk string ($-1).
+func (w *Writer) WriteNullBulk() error {
+	_, err := w.Write(nilBulk)
+	return err
+}
+
+// WriteNullArray writes a null array (*-1).
+func (w *Writer) WriteNullArray() error {
+	_, err := w.Write(nilArray)
+	return err
+}
+
+// SetProtocolVersion selects the RESP version of the connection, e.g. after a HELLO exchange. RESP3 only frames
+// like maps and sets can be written once it's 3, the default is RESP2.
+func (w *Writer) SetProtocolVersion(v int) {
+	w.resp3 = v == 3
+}
+
+// WriteMapHeader writes only the header of a RESP3 map of n entries, the caller must write 2n values after it,
+// alternating keys and values. Like WriteArrayHeader the values can be nested aggregates. It fails with
+// ErrNeedRESP3 unless the writer speaks RESP3.
+func (w *Writer) WriteMapHeader(n int) error {
+	return w.writeRESP3Header(percent, n)
+}
+
+// WriteSetHeader writes only the header of a RESP3 set of n elements, see WriteMapHeader.
+func (w *Writer) WriteSetHeader(n int) error {
+	return w.writeRESP3Header(tilde, n)
+}
+
+func (w *Writer) writeRESP3Header(typ []byte, n int) error {
+	if !w.resp3 {
+		return ErrNeedRESP3
+	}
+	w.Write(typ)
+	w.Write(strconv.AppendInt(nil, int64(n), 10))
+	_, err := w.Write(newLine)
+	return err
+}
+
+// WriteDouble writes a RESP3 double, infinities and NaN as "inf", "-inf" and "nan".
+func (w *Writer) WriteDouble(f float64) error {
+	dst := []byte{','}
+	switch {
+	case math.IsInf(f, 1):
+		dst = append(dst, "inf"...)
+	case math.IsInf(f, -1):
+		dst = append(dst, "-inf"...)
+	case math.IsNaN(f):
+		dst = append(dst, "nan"...)
+	default:
+		dst = strconv.AppendFloat(dst, f, 'g', -1, 64)
+	}
+	return w.writeRESP3(append(dst, newLine...))
+}
+
+// WriteVerbatim writes a RESP3 verbatim string of body in format, a 3 character type like "txt" or "mkd".
+func (w *Writer) WriteVerbatim(format, body string) error {
+	if len(format) != 3 {
+		return ErrVerbatimFormat
+	}
+	dst := append([]byte{'='}, strconv.Itoa(len(format)+1+len(body))...)
+	dst = append(append(append(dst, newLine...), format...), ':')
+	return w.writeRESP3(append(append(dst, body...), newLine...))
+}
+
+// WriteBool writes a RESP3 boolean.
+func (w *Writer) WriteBool(b bool) error {
+	if b {
+		return w.writeRESP3(boolT)
+	}
+	return w.writeRESP3(boolF)
+}
+
+// WriteNull writes the RESP3 null, which replaces both the null bulk and the null array of RESP2.
+func (w *Writer) WriteNull() error {
+	return w.writeRESP3(nullFrame)
+}
+
+// WriteBigNumber writes a RESP3 big number, a nil n is written as a null.
+func (w *Writer) WriteBigNumber(n *big.Int) error {
+	if n == nil {
+		return w.WriteNull()
+	}
+	return w.writeRESP3(append(n.Append([]byte{'('}, 10), newLine...))
+}
+
+func (w *Writer) writeRESP3(frame []byte) error {
+	if !w.resp3 {
+		return ErrNeedRESP3
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// WriteArrayHeader writes only the header of an array of n elements, the caller must write exactly n values
+// after it. Values can be arrays started by another WriteArrayHeader to build nested replies, this allows
+// streaming large arrays without building them in memory first.
+func (w *Writer) WriteArrayHeader(n int) error {
+	w.Write(star)
+	w.Write(strconv.AppendInt(nil, int64(n), 10))
+	_, err := w.Write(newLine)
+	return err
+}
+
 func (w *Writer) WriteObjects(objs ...interface{}) error {
 	if objs == nil {
 		_, err := w.Write(nilArray)
@@ -173,3 +432,37 @@ func (w *Writer) WriteBulkStrings(bulks []string) error {
 	}
 	return nil
 }
+
+// WriteCommand writes args as a command in RESP multi-bulk form, as a client sends it to a server.
+func (w *Writer) WriteCommand(args ...[]byte) error {
+	if err := w.WriteArrayHeader(len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := w.WriteBulk(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteReply writes a parsed command back in its RESP frame, Number, Status, Error and Bulk as scalar frames
+// and arrays with their nested elements, e.g. to replay a cached reply. Streamed aggregates are written with
+// their length.
+func (w *Writer) WriteReply(cmd *Command) error {
+	_, err := w.Write(cmd.appendRESP(nil))
+	return err
+}
+
+// WriteCommandStrings works like WriteCommand for string arguments.
+func (w *Writer) WriteCommandStrings(args ...string) error {
+	if err := w.WriteArrayHeader(len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := w.WriteBulkString(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,13 @@
 package redisproto
 
 import (
+	"bufio"
 	"bytes"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -31,3 +37,273 @@ func TestWriter_WriteSlice2(t *testing.T) {
 		t.Errorf("Unexpected WriteObjectsSlice, got %s", buff.String())
 	}
 }
+
+func TestWriter_WriteArrayHeader(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	w.WriteArrayHeader(3)
+	w.WriteBulkString("item")
+	w.WriteArrayHeader(2)
+	w.WriteInt(1)
+	w.WriteNullBulk()
+	w.WriteNullArray()
+	if buff.String() != "*3\r\n$4\r\nitem\r\n*2\r\n:1\r\n$-1\r\n*-1\r\n" {
+		t.Fatalf("Unexpected nested reply %q", buff.String())
+	}
+	cmd, err := NewParser(buff).ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	children := cmd.Children()
+	if len(children) != 3 || string(children[0].Get(0)) != "item" {
+		t.Fatalf("Unexpected parsed reply")
+	}
+	nested := children[1].Children()
+	if len(nested) != 2 || nested[0].Int() != 1 || nested[1].Type() != Bulk || nested[1].Get(0) != nil {
+		t.Errorf("Unexpected nested array")
+	}
+	if !children[2].IsNil() {
+		t.Errorf("Expect null array")
+	}
+}
+
+func TestWriter_WriteErrorCode(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	w.WriteErrorCode("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+	if buff.String() != "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" {
+		t.Errorf("Unexpected WriteErrorCode %q", buff.String())
+	}
+	buff.Reset()
+	w.WriteErrorCode("ERR\r\n+OK", "no such key 'k\r\n+OK'")
+	if buff.String() != "-ERR  +OK no such key 'k  +OK'\r\n" {
+		t.Errorf("Unexpected WriteErrorCode %q", buff.String())
+	}
+	cmd, err := newReplyParser(buff).ReadCommand()
+	if err != nil || cmd.Type() != Error || buff.Len() != 0 {
+		t.Errorf("Expect a single error reply %v %v", cmd, err)
+	}
+}
+
+func TestWriter_WriteErrorf(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	w.WriteErrorf("ERR unknown command '%s', with %d args", "x\r\n+OK", 2)
+	if buff.String() != "-ERR unknown command 'x  +OK', with 2 args\r\n" {
+		t.Errorf("Unexpected WriteErrorf %q", buff.String())
+	}
+	cmd, err := newReplyParser(buff).ReadCommand()
+	if err != nil || cmd.Type() != Error || buff.Len() != 0 {
+		t.Errorf("Expect a single error reply %v %v", cmd, err)
+	}
+}
+
+func TestWriter_WriteInline(t *testing.T) {
+	args := [][]byte{[]byte("SET"), []byte("a key"), []byte(`say "hi"\x41`), {}, []byte("it's"), {0, '\t', 0x7f, 0xff},
+		[]byte(`back\slash`)}
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	if err := w.WriteInline(args...); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if expect := `SET "a key" "say \"hi\"\\x41" "" "it's" "\x00\x09\x7f` + "\xff\"" + ` back\slash` + "\r\n"; buff.String() != expect {
+		t.Errorf("Unexpected inline command %q, expect %q", buff.String(), expect)
+	}
+	parser := NewParserWithOptions(buff, ParserOptions{QuotedInline: true, StrictInline: true})
+	cmd, err := parser.ReadCommand()
+	if err != nil || !cmd.Inline() || !cmd.EqualArgs(args...) {
+		t.Errorf("Unexpected round trip %q %v", cmd.Args(), err)
+	}
+	if err := w.WriteInline([]byte("SET"), []byte("k"), []byte("a\nb")); err != ErrInlineNewline || buff.Len() != 0 {
+		t.Errorf("Expect ErrInlineNewline, got %v", err)
+	}
+}
+
+func TestWriter_WriteAndMaybeFlush(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(bufio.NewWriter(buff))
+	parser := NewParser(strings.NewReader("*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n"))
+	pong := func(w *Writer) error {
+		return w.WriteSimpleString("PONG")
+	}
+	cmd, _ := parser.ReadCommand()
+	w.WriteAndMaybeFlush(cmd, pong)
+	if buff.Len() != 0 || w.Buffered() != 7 {
+		t.Errorf("Unexpected flush before the last command")
+	}
+	cmd, _ = parser.ReadCommand()
+	w.WriteAndMaybeFlush(cmd, pong)
+	if buff.String() != "+PONG\r\n+PONG\r\n" || w.Buffered() != 0 {
+		t.Errorf("Expect flush after the last command, got %q", buff.String())
+	}
+}
+
+func TestWriter_FlushThreshold(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(bufio.NewWriter(buff))
+	w.SetFlushThreshold(10)
+	parser := NewParser(strings.NewReader(strings.Repeat("*1\r\n$4\r\nPING\r\n", 3)))
+	for i := 0; i < 2; i++ {
+		cmd, _ := parser.ReadCommand()
+		w.WriteAndMaybeFlush(cmd, func(w *Writer) error {
+			return w.WriteSimpleString("PONG")
+		})
+	}
+	if buff.String() != "+PONG\r\n+PONG\r\n" {
+		t.Errorf("Expect flush over threshold, got %q", buff.String())
+	}
+}
+
+func TestWriter_WriteCommand(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	w.WriteCommand([]byte("SET"), []byte("k"), []byte(""))
+	w.WriteCommandStrings("GET", "k")
+	if buff.String() != "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n" {
+		t.Fatalf("Unexpected WriteCommand %q", buff.String())
+	}
+	parser := NewParser(buff)
+	cmd, err := parser.ReadCommand()
+	if err != nil || cmd.ArgCount() != 3 || string(cmd.Get(0)) != "SET" || len(cmd.Get(2)) != 0 || cmd.IsNull(2) {
+		t.Errorf("Unexpected parsed command %v", err)
+	}
+	cmd, err = parser.ReadCommand()
+	if err != nil || cmd.ArgCount() != 2 || string(cmd.Get(1)) != "k" {
+		t.Errorf("Unexpected parsed command %v", err)
+	}
+}
+
+func TestWriter_WriteReply(t *testing.T) {
+	input := ":42\r\n+OK\r\n-ERR bad\r\n$-1\r\n*-1\r\n*3\r\n:1\r\n*2\r\n+a\r\n$-1\r\n$1\r\nb\r\n"
+	parser := newReplyParser(strings.NewReader(input))
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	for {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			break
+		}
+		if err = w.WriteReply(cmd); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if buff.String() != input {
+		t.Errorf("Unexpected round trip %q", buff.String())
+	}
+	cmd, _ := resp3(NewParser(strings.NewReader("*?\r\n:1\r\n.\r\n"))).ReadCommand()
+	buff.Reset()
+	w.WriteReply(cmd)
+	if buff.String() != "*1\r\n:1\r\n" {
+		t.Errorf("Unexpected streamed reply %q", buff.String())
+	}
+}
+
+func TestWriter_WriteMapHeader(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	if err := w.WriteMapHeader(1); err != ErrNeedRESP3 || buff.Len() != 0 {
+		t.Fatalf("Unexpected RESP2 map %v %q", err, buff.String())
+	}
+	w.SetProtocolVersion(3)
+	w.WriteMapHeader(2)
+	w.WriteBulkString("name")
+	w.WriteSimpleString("redis")
+	w.WriteBulkString("modules")
+	w.WriteSetHeader(2)
+	w.WriteBulkString("a")
+	w.WriteInt(1)
+	if buff.String() != "%2\r\n$4\r\nname\r\n+redis\r\n$7\r\nmodules\r\n~2\r\n$1\r\na\r\n:1\r\n" {
+		t.Fatalf("Unexpected map %q", buff.String())
+	}
+	parser := newReplyParser(buff)
+	parser.SetProtocolVersion(3)
+	cmd, err := parser.ReadCommand()
+	if err != nil || cmd.Type() != Map || len(cmd.Children()) != 4 || cmd.Children()[3].Type() != Set {
+		t.Fatalf("Unexpected parsed map %v %v", cmd, err)
+	}
+	var v interface{}
+	cmd.Unmarshal(&v)
+	if m := v.(map[string]interface{}); m["name"] != "redis" || len(m["modules"].([]interface{})) != 2 {
+		t.Errorf("Unexpected decoded map %v", v)
+	}
+}
+
+func TestWriter_WriteRESP3Scalars(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	if w.WriteDouble(1) != ErrNeedRESP3 || w.WriteBool(true) != ErrNeedRESP3 || w.WriteNull() != ErrNeedRESP3 ||
+		w.WriteVerbatim("txt", "x") != ErrNeedRESP3 || w.WriteBigNumber(big.NewInt(1)) != ErrNeedRESP3 || buff.Len() != 0 {
+		t.Fatalf("Unexpected RESP2 output %q", buff.String())
+	}
+	w.SetProtocolVersion(3)
+	if err := w.WriteVerbatim("text", "x"); err != ErrVerbatimFormat {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	n, _ := new(big.Int).SetString("3492890328409238509324850943850943825024385", 10)
+	w.WriteDouble(1.5)
+	w.WriteDouble(math.Inf(1))
+	w.WriteDouble(math.Inf(-1))
+	w.WriteDouble(math.NaN())
+	w.WriteVerbatim("txt", "Some string")
+	w.WriteBool(true)
+	w.WriteBool(false)
+	w.WriteNull()
+	w.WriteBigNumber(n)
+	w.WriteBigNumber(nil)
+	expect := ",1.5\r\n,inf\r\n,-inf\r\n,nan\r\n=15\r\ntxt:Some string\r\n#t\r\n#f\r\n_\r\n" +
+		"(3492890328409238509324850943850943825024385\r\n_\r\n"
+	if buff.String() != expect {
+		t.Fatalf("Unexpected output %q", buff.String())
+	}
+
+	parser := newReplyParser(buff)
+	parser.SetProtocolVersion(3)
+	var values []interface{}
+	for i := 0; i < 10; i++ {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		var v interface{}
+		cmd.Unmarshal(&v)
+		values = append(values, v)
+	}
+	if values[0] != 1.5 || !math.IsInf(values[1].(float64), 1) || !math.IsInf(values[2].(float64), -1) ||
+		!math.IsNaN(values[3].(float64)) {
+		t.Errorf("Unexpected doubles %v", values[:4])
+	}
+	if values[4] != "txt:Some string" || values[5] != true || values[6] != false || values[7] != nil ||
+		values[8] != n.String() || values[9] != nil {
+		t.Errorf("Unexpected values %v", values[4:])
+	}
+}
+
+func TestWriter_WriteBulkInt(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	w := NewWriter(buff)
+	w.WriteBulkInt(-9223372036854775808)
+	w.WriteBulkInt(0)
+	w.WriteIntArray([]int64{1, -2, 30})
+	w.WriteIntArray(nil)
+	w.WriteIntArray([]int64{})
+	expect := "$20\r\n-9223372036854775808\r\n$1\r\n0\r\n*3\r\n:1\r\n:-2\r\n:30\r\n*-1\r\n*0\r\n"
+	if buff.String() != expect {
+		t.Errorf("Unexpected output %q", buff.String())
+	}
+}
+
+func BenchmarkWriter_WriteBulkInt(b *testing.B) {
+	w := NewWriter(bufio.NewWriter(io.Discard))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.WriteBulkInt(int64(i))
+	}
+}
+
+func BenchmarkWriter_WriteBulkIntNaive(b *testing.B) {
+	w := NewWriter(bufio.NewWriter(io.Discard))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.WriteBulkString(strconv.FormatInt(int64(i), 10))
+	}
+}